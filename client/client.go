@@ -0,0 +1,192 @@
+// Package client sends commands to the local API of an EAGLE, the XML
+// interface it serves at /cgi-bin/cgi_manager, and parses its responses into
+// the fragment types of package server.
+package client
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/rmg/eagle/server"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CommandPath is where an EAGLE takes commands
+const CommandPath = "/cgi-bin/cgi_manager"
+
+// DefaultTimeout is how long a command is given when the Client has no
+// http.Client of its own. The EAGLE has to ask the meter for some answers, so
+// it can be slow.
+var DefaultTimeout = 30 * time.Second
+
+// A Client sends commands to one EAGLE. Username and Password are the Cloud
+// ID and Install Code printed on its label, and MacId is the MAC address of
+// its ZigBee radio, which is sent with every command.
+type Client struct {
+	URL      string
+	Username string
+	Password string
+	MacId    server.MacAddrHex
+	HTTP     *http.Client
+}
+
+func New(url, username, password string, mac server.MacAddrHex) *Client {
+	return &Client{URL: url, Username: username, Password: password, MacId: mac}
+}
+
+// An Error is an HTTP error returned by the EAGLE
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("EAGLE returned %d: %s", e.StatusCode, e.Body)
+}
+
+// Send a command, one of server.LocalCommand or server.RavenCommand, and
+// return the body of the response
+func (c *Client) Send(cmd interface{}) ([]byte, error) {
+	body, err := xml.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URL, "/")+CommandPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, &Error{res.StatusCode, strings.TrimSpace(string(buf))}
+	}
+	return buf, nil
+}
+
+// Do sends a command and decodes the first fragment called name in the
+// response into v
+func (c *Client) Do(cmd interface{}, name string, v interface{}) error {
+	buf, err := c.Send(cmd)
+	if err != nil {
+		return err
+	}
+	return decodeFragment(buf, name, v)
+}
+
+// Find the element called name, whether it's the whole response or inside a
+// <rainforest> document like the EAGLE uploads, and decode it into v
+func decodeFragment(buf []byte, name string, v interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("no %s in response %q", name, truncate(string(buf), 200))
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			return decoder.DecodeElement(v, &start)
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// LocalCommand makes a command with no arguments for the client's EAGLE
+func (c *Client) LocalCommand(name string) server.LocalCommand {
+	return server.LocalCommand{Command: server.Command{Name: name, MacId: c.MacId}}
+}
+
+func (c *Client) NetworkInfo() (server.NetworkInfoFragment, error) {
+	info := server.NetworkInfoFragment{}
+	err := c.Do(c.LocalCommand("get_network_info"), "NetworkInfo", &info)
+	return info, err
+}
+
+func (c *Client) DeviceInfo() (server.DeviceInfoFragment, error) {
+	info := server.DeviceInfoFragment{}
+	err := c.Do(c.LocalCommand("get_device_data"), "DeviceInfo", &info)
+	return info, err
+}
+
+func (c *Client) InstantaneousDemand() (server.InstantaneousDemandFragment, error) {
+	demand := server.InstantaneousDemandFragment{}
+	err := c.Do(c.LocalCommand("get_instantaneous_demand"), "InstantaneousDemand", &demand)
+	return demand, err
+}
+
+func (c *Client) Price() (server.PriceClusterFragment, error) {
+	price := server.PriceClusterFragment{}
+	err := c.Do(c.LocalCommand("get_price"), "PriceCluster", &price)
+	return price, err
+}
+
+func (c *Client) FastPollStatus() (server.FastPollStatusFragment, error) {
+	status := server.FastPollStatusFragment{}
+	err := c.Do(c.LocalCommand("get_fast_poll_status"), "FastPollStatus", &status)
+	return status, err
+}
+
+// SetFastPoll starts fast polling the meter. The EAGLE only acknowledges the
+// command; FastPollStatus says whether it took.
+func (c *Client) SetFastPoll(f server.SetFastPoll) error {
+	_, err := c.Send(f.Command(c.MacId))
+	return err
+}
+
+// HistoryData asks for the summation at every frequency between start and
+// end. A zero end means up to now.
+func (c *Client) HistoryData(start, end time.Time, frequency time.Duration) (server.HistoryDataFragment, error) {
+	cmd := c.LocalCommand("get_history_data")
+	startTime := server.NewEagleTime(start)
+	cmd.StartTime = &startTime
+	if !end.IsZero() {
+		endTime := server.NewEagleTime(end)
+		cmd.EndTime = &endTime
+	}
+	cmd.Frequency = server.HexInt(frequency / time.Second)
+	history := server.HistoryDataFragment{}
+	err := c.Do(cmd, "HistoryData", &history)
+	return history, err
+}
+
+// ProfileData asks the meter for up to 12 intervals from a channel, either
+// Delivered or Received, ending at end. A zero end means the most recent.
+func (c *Client) ProfileData(meter server.MacAddrHex, periods int, end time.Time, channel string) (server.ProfileDataFragment, error) {
+	endTime := server.NewEagleTime(end)
+	if end.IsZero() {
+		endTime = server.EagleTime(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC))
+	}
+	cmd := server.RavenCommand{
+		Command:         server.Command{Name: "get_profile_data", MacId: c.MacId},
+		DeviceMacId:     c.MacId,
+		MeterMacId:      meter,
+		NumberOfPeriods: server.HexInt(periods),
+		EndTime:         &endTime,
+		IntervalChannel: channel,
+	}
+	profile := server.ProfileDataFragment{}
+	err := c.Do(cmd, "ProfileData", &profile)
+	return profile, err
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"encoding/xml"
+	"github.com/rmg/eagle/server"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var eagleMac = server.MacAddrHex{0xd8, 0xd5, 0xb9, 0x00, 0x00, 0x00, 0x2a, 0xea}
+
+// The parts of any command the fake gateway looks at
+type command struct {
+	XMLName         xml.Name
+	Name            string
+	MacId           string
+	MeterMacId      string
+	Frequency       string
+	Duration        string
+	StartTime       string
+	EndTime         string
+	NumberOfPeriods string
+	IntervalChannel string
+}
+
+// A fake EAGLE that answers commands with canned responses and records what
+// it was sent
+func fakeGateway(t *testing.T, responses map[string]string) (*httptest.Server, *[]command) {
+	received := []command{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != CommandPath {
+			w.WriteHeader(404)
+			return
+		}
+		if username, password, ok := req.BasicAuth(); !ok || username != "00abcd" || password != "1234567890abcdef" {
+			w.WriteHeader(401)
+			w.Write([]byte("Unauthorized"))
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		cmd := command{}
+		if err := xml.Unmarshal(body, &cmd); err != nil {
+			t.Errorf("Bad command %s: %v", body, err)
+		}
+		received = append(received, cmd)
+		response, ok := responses[cmd.Name]
+		if !ok {
+			w.WriteHeader(400)
+			w.Write([]byte("Unknown command"))
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	return server, &received
+}
+
+func TestClientCommands(t *testing.T) {
+	gateway, received := fakeGateway(t, map[string]string{
+		"get_network_info": `<NetworkInfo>
+  <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+  <CoordMacId>0x00078100007d67bb</CoordMacId>
+  <Status>Connected</Status>
+  <LinkStrength>0x64</LinkStrength>
+</NetworkInfo>`,
+		"get_instantaneous_demand": `<rainforest macId="0xd8d5b90000002aea">
+<InstantaneousDemand>
+  <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+  <MeterMacId>0x00078100007d67bb</MeterMacId>
+  <TimeStamp>0x1b8d9bf3</TimeStamp>
+  <Demand>0x001738</Demand>
+  <Multiplier>0x00000001</Multiplier>
+  <Divisor>0x000003e8</Divisor>
+</InstantaneousDemand>
+</rainforest>`,
+		"set_fast_poll": ``,
+		"get_fast_poll_status": `<FastPollStatus>
+  <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+  <MeterMacId>0x00078100007d67bb</MeterMacId>
+  <Frequency>0x01</Frequency>
+  <EndTime>0x1b8d9d1f</EndTime>
+</FastPollStatus>`,
+		"get_history_data": `<HistoryData>
+  <CurrentSummation>
+    <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+    <MeterMacId>0x00078100007d67bb</MeterMacId>
+    <TimeStamp>0x1b8d9bf3</TimeStamp>
+    <SummationDelivered>0x000000000038fa2</SummationDelivered>
+    <Multiplier>0x00000001</Multiplier>
+    <Divisor>0x000003e8</Divisor>
+  </CurrentSummation>
+</HistoryData>`,
+	})
+	defer gateway.Close()
+	c := New(gateway.URL, "00abcd", "1234567890abcdef", eagleMac)
+
+	info, err := c.NetworkInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != "Connected" || info.LinkStrength != 100 || info.CoordMacId.String() != "00:07:81:00:00:7d:67:bb" {
+		t.Errorf("Got network info %+v", info)
+	}
+
+	demand, err := c.InstantaneousDemand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if demand.Demand != 0x1738 || demand.Divisor != 1000 {
+		t.Errorf("Got demand %+v", demand)
+	}
+
+	err = c.SetFastPoll(server.SetFastPoll{
+		MeterMacId: server.MacAddrHex{0x00, 0x07, 0x81, 0x00, 0x00, 0x7d, 0x67, 0xbb},
+		Frequency:  time.Second,
+		Duration:   15 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.FastPollStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Frequency != 1 || status.EndTime.Seconds() != 0x1b8d9d1f {
+		t.Errorf("Got fast poll status %+v", status)
+	}
+
+	start := time.Date(2014, time.August, 20, 0, 0, 0, 0, time.UTC)
+	history, err := c.HistoryData(start, time.Time{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.CurrentSummation) != 1 || history.CurrentSummation[0].SummationDelivered != 0x38fa2 {
+		t.Errorf("Got history %+v", history)
+	}
+
+	expected := []command{
+		{Name: "get_network_info"},
+		{Name: "get_instantaneous_demand"},
+		{Name: "set_fast_poll", MeterMacId: "0x00078100007d67bb", Frequency: "0x01", Duration: "0x0f"},
+		{Name: "get_fast_poll_status"},
+		{Name: "get_history_data", StartTime: "0x1b86a180", Frequency: "0xe10"},
+	}
+	roots := []string{"LocalCommand", "LocalCommand", "RavenCommand", "LocalCommand", "LocalCommand"}
+	if len(*received) != len(expected) {
+		t.Fatalf("Sent %+v", *received)
+	}
+	for i, cmd := range *received {
+		expected[i].XMLName.Local = roots[i]
+		expected[i].MacId = "0xd8d5b90000002aea"
+		if cmd != expected[i] {
+			t.Errorf("Sent %+v instead of %+v", cmd, expected[i])
+		}
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	gateway, _ := fakeGateway(t, map[string]string{"get_price": `<Error>Not ready</Error>`})
+	defer gateway.Close()
+
+	c := New(gateway.URL, "00abcd", "wrong", eagleMac)
+	if _, err := c.Price(); err == nil || err.(*Error).StatusCode != 401 {
+		t.Errorf("Expected a 401, got %v", err)
+	}
+	c.Password = "1234567890abcdef"
+	if _, err := c.Price(); err == nil {
+		t.Errorf("Expected an error for a response without PriceCluster")
+	}
+	if _, err := c.NetworkInfo(); err == nil || err.(*Error).Body != "Unknown command" {
+		t.Errorf("Expected an unknown command, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const fastpollUsage = `usage: eagle fastpoll [-frequency 1s] [-duration 15m] [-for DURATION] [-meter MAC] GATEWAY
+       eagle fastpoll -cancel GATEWAY
+       eagle fastpoll -status`
+
+// Ask a running server to fast poll an EAGLE, or show the fast poll state of
+// each EAGLE. The server is at EAGLE_URL, or on PORT of localhost, and
+// EAGLE_API_KEY is sent if the API needs a key.
+func fastpollCommand(args []string) {
+	flags := flag.NewFlagSet("fastpoll", flag.ExitOnError)
+	frequency := flags.String("frequency", "1s", "how often to poll the meter, up to 255s")
+	duration := flags.String("duration", "15m", "how long each request lasts, up to 15m")
+	keep := flags.String("for", "", "how long to keep renewing the request")
+	meter := flags.String("meter", "", "MAC address of the meter")
+	cancel := flags.Bool("cancel", false, "stop renewing requests to the gateway")
+	status := flags.Bool("status", false, "show the fast poll state of each gateway")
+	flags.Parse(args)
+
+	base := os.Getenv("EAGLE_URL")
+	if base == "" {
+		base = "http://localhost" + portOrDefault("8000")
+	}
+	method, values := "GET", url.Values{}
+	switch {
+	case *status && flags.NArg() == 0:
+	case flags.NArg() != 1:
+		log.Fatal(fastpollUsage)
+	case *cancel:
+		method = "DELETE"
+		values.Set("gateway", flags.Arg(0))
+	default:
+		method = "POST"
+		values.Set("gateway", flags.Arg(0))
+		values.Set("frequency", *frequency)
+		values.Set("duration", *duration)
+		if *keep != "" {
+			values.Set("for", *keep)
+		}
+		if *meter != "" {
+			values.Set("meter", *meter)
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+"/fastpoll?"+values.Encode(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if key := os.Getenv("EAGLE_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		log.Fatalf("%s: %s", res.Status, body)
+	}
+	fmt.Println(string(body))
+}
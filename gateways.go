@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rmg/eagle/client"
+	"github.com/rmg/eagle/server"
+	"log"
+	"strings"
+	"time"
+)
+
+// Give the server a client for the local API of each EAGLE with a
+// GATEWAY_<MAC>_LOCAL_URL, where MAC is the macId of its uploads in hex, to
+// fast poll it and fetch its history. GATEWAY_<MAC>_CLOUD_ID and
+// GATEWAY_<MAC>_INSTALL_CODE are its credentials and GATEWAY_<MAC>_DEVICE the
+// MAC address of its ZigBee radio. BACKFILL_GAP and BACKFILL_FREQUENCY
+// override the longest time between summations that isn't a gap and the
+// interval of the history fetched. Returns how many there are.
+func configureGateways(environ []string) int {
+	env := server.EnvironMap(environ)
+	settings := map[string]*time.Duration{
+		"BACKFILL_GAP":       &server.Backfills.Gap,
+		"BACKFILL_FREQUENCY": &server.Backfills.Frequency,
+	}
+	for name, setting := range settings {
+		if v := env[name]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err == nil && d <= 0 {
+				err = fmt.Errorf("%s is not positive", v)
+			}
+			if err != nil {
+				log.Fatal(name+": ", err)
+			}
+			*setting = d
+		}
+	}
+	n := 0
+	for k, v := range env {
+		if !strings.HasPrefix(k, "GATEWAY_") || !strings.HasSuffix(k, "_LOCAL_URL") {
+			continue
+		}
+		prefix := strings.TrimSuffix(k, "LOCAL_URL")
+		gateway, err := server.ParseMacAddr(strings.TrimPrefix(prefix[:len(prefix)-1], "GATEWAY_"))
+		if err != nil {
+			log.Fatalf("%s: %v", k, err)
+		}
+		device := server.MacAddrHex{}
+		if err := device.UnmarshalText([]byte(env[prefix+"DEVICE"])); err != nil {
+			log.Fatalf("%sDEVICE: %v", prefix, err)
+		}
+		c := client.New(v, env[prefix+"CLOUD_ID"], env[prefix+"INSTALL_CODE"], device)
+		server.FastPolls.AddGateway(gateway, c)
+		server.Backfills.AddGateway(gateway, c)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rmg/eagle/server"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Where API keys are kept: API_KEYS_FILE, or keys.json in DATA_DIR
+func keysPath() string {
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return filepath.Join(dir, "keys.json")
+	}
+	return ""
+}
+
+// A list of values from a flag that can be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+const keysUsage = `usage: eagle keys create [-scope read|admin] [-meter MAC]... NAME
+       eagle keys list
+       eagle keys revoke ID`
+
+// Manage the API keys of the query API:
+//
+//	eagle keys create [-scope read|admin] [-meter MAC]... NAME
+//	eagle keys list
+//	eagle keys revoke ID
+func keysCommand(args []string) {
+	path := keysPath()
+	if path == "" {
+		log.Fatal("Set API_KEYS_FILE or DATA_DIR to say where the keys are kept")
+	}
+	if len(args) == 0 {
+		log.Fatal(keysUsage)
+	}
+	keys, err := server.OpenKeyStore(path)
+	if err != nil {
+		log.Fatal("Loading API keys: ", err)
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		scope := flags.String("scope", "read", "read or admin")
+		meters := listFlag{}
+		flags.Var(&meters, "meter", "limit the key to a meter's data, may be repeated")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			log.Fatal(keysUsage)
+		}
+		s, err := server.ParseScope(*scope)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, m := range meters {
+			if meters[i], err = server.ParseMacAddr(m); err != nil {
+				log.Fatalf("meter %s: %v", m, err)
+			}
+		}
+		token, key, err := keys.Create(flags.Arg(0), s, meters, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "Created %s key %s; the token can't be shown again\n", key.Scope, key.Id)
+		fmt.Println(token)
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPE\tMETERS\tCREATED")
+		for _, k := range list {
+			meters := strings.Join(k.Meters, ",")
+			if meters == "" {
+				meters = "all"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.Id, k.Name, k.Scope, meters, k.Created.Format(time.RFC3339))
+		}
+		w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			log.Fatal(keysUsage)
+		}
+		if err := keys.Revoke(args[1]); err == server.ErrLastAdminKey {
+			log.Fatalf("%s: %v; create another admin key first", args[1], err)
+		} else if err != nil {
+			log.Fatalf("%s: %v", args[1], err)
+		}
+	default:
+		log.Fatal(keysUsage)
+	}
+}
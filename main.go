@@ -5,10 +5,79 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		keysCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fastpoll" {
+		fastpollCommand(os.Args[2:])
+		return
+	}
+	if env := os.Getenv("PRECISION"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			log.Fatal("PRECISION: ", err)
+		}
+		server.Precision = n
+	}
+	if env := os.Getenv("BILLING_DAY"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil || n < 1 || n > 28 {
+			log.Fatalf("BILLING_DAY: %q is not a day from 1 to 28", env)
+		}
+		server.BillingDay = n
+	}
+	server.Readings = openStore()
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		messages, err := server.OpenMessageStore(filepath.Join(dir, "messages.json"))
+		if err != nil {
+			log.Fatal("Loading messages: ", err)
+		}
+		server.Messages = messages
+		devices, err := server.OpenDeviceTracker(filepath.Join(dir, "devices.json"))
+		if err != nil {
+			log.Fatal("Loading devices: ", err)
+		}
+		server.Devices = devices
+		if err := server.Backfills.LoadScales(filepath.Join(dir, "scales.json")); err != nil {
+			log.Fatal("Loading meter scales: ", err)
+		}
+	}
+	if path := keysPath(); path != "" {
+		keys, err := server.OpenKeyStore(path)
+		if err != nil {
+			log.Fatal("Loading API keys: ", err)
+		}
+		server.APIKeys = keys
+	}
+	server.APIKeys.Open = os.Getenv("API_OPEN") == "1"
+	// Pick up the running costs of each meter where they were left
+	server.Costs.Add(server.Readings.Range(server.Billing.Start(time.Now()), time.Time{})...)
+	if err := server.Sinks.ConfigureSinks(os.Environ()); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Uploads.ConfigureUploads(os.Environ()); err != nil {
+		log.Fatal(err)
+	}
+	if configureGateways(os.Environ()) > 0 {
+		go server.Backfills.Run(server.Readings, time.Hour, nil)
+	}
 	http.HandleFunc("/metrics", server.MetricsHandler)
+	http.Handle("/sinks", server.APIKeys.Require(server.AdminScope, http.HandlerFunc(server.SinksHandler)))
+	http.HandleFunc("/cost", server.CostHandler)
+	http.HandleFunc("/blocks", server.BlocksHandler)
+	http.HandleFunc("/messages", server.MessagesHandler)
+	http.HandleFunc("/devices", server.DevicesHandler)
+	http.HandleFunc("/fastpoll", server.FastPollHandler)
+	http.HandleFunc("/backfill", server.BackfillHandler)
+	http.Handle("/inventory", server.APIKeys.Require(server.AdminScope, http.HandlerFunc(server.InventoryHandler)))
+	http.Handle(pathOrDefault("PROMETHEUS_PATH", "/metrics/prometheus"), server.APIKeys.Require(server.ReadScope, server.Prometheus))
 	err := http.ListenAndServe(portOrDefault("8000"), nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
@@ -26,3 +95,53 @@ func portOrDefault(dflt string) string {
 
 	return ":" + port
 }
+
+// Get an HTTP path from the environment
+func pathOrDefault(name, dflt string) string {
+	if path := os.Getenv(name); path != "" {
+		return path
+	}
+	return dflt
+}
+
+// Keep readings in memory, and on disk if DATA_DIR is set
+func openStore() server.Store {
+	capacity := server.DefaultCapacity
+	if env := os.Getenv("METRICS_CAPACITY"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			log.Fatal("METRICS_CAPACITY: ", err)
+		}
+		capacity = n
+	}
+	cache := server.NewMemoryStore(capacity)
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return cache
+	}
+	opts := server.SegmentLogOptions{}
+	if env := os.Getenv("RETENTION"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			log.Fatal("RETENTION: ", err)
+		}
+		opts.Retention = d
+	}
+	if env := os.Getenv("SEGMENT_SIZE"); env != "" {
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			log.Fatal("SEGMENT_SIZE: ", err)
+		}
+		opts.SegmentSize = n
+	}
+	backend, err := server.OpenSegmentLog(dir, opts)
+	if err != nil {
+		log.Fatal("Opening DATA_DIR: ", err)
+	}
+	store, err := server.NewPersistentStore(cache, backend)
+	if err != nil {
+		log.Fatal("Loading readings: ", err)
+	}
+	go store.Compact(time.Hour, nil)
+	return store
+}
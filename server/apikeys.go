@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Scope is what an API key may do. Admin keys can do everything read keys
+// can.
+type Scope string
+
+const (
+	ReadScope  Scope = "read"
+	AdminScope Scope = "admin"
+)
+
+func ParseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case ReadScope, AdminScope:
+		return Scope(s), nil
+	}
+	return "", fmt.Errorf("unknown scope %q", s)
+}
+
+var (
+	ErrNoAPIKey     = errors.New("missing API key")
+	ErrBadAPIKey    = errors.New("unknown or revoked API key")
+	ErrUnknownKeyId = errors.New("no such key")
+	ErrNoKeys       = errors.New("no API keys have been created")
+	ErrLastAdminKey = errors.New("can't revoke the last admin key")
+)
+
+// An APIKey lets a client read from the query API. Only a hash of its secret
+// is kept, so a key can't be recovered once it has been handed out.
+type APIKey struct {
+	Id    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Scope Scope  `json:"scope"`
+	// Meters limits a read key to those meters' data; empty allows them all
+	Meters  []string  `json:"meters,omitempty"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+func (k APIKey) allows(scope Scope) bool {
+	return k.Scope == AdminScope || k.Scope == scope
+}
+
+// AllowsMeter is whether the key may read the data of a meter
+func (k APIKey) AllowsMeter(meter string) bool {
+	if len(k.Meters) == 0 {
+		return true
+	}
+	for _, m := range k.Meters {
+		if m == meter {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// A KeyStore holds API keys in a JSON file if it has a path. The file is
+// reloaded when it changes, so keys managed from the command line take effect
+// without a restart.
+type KeyStore struct {
+	// Open lets everyone in as an admin while there are no keys. Otherwise
+	// every request is refused until a key has been created.
+	Open bool
+
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	keys    map[string]APIKey
+}
+
+// APIKeys checks the requests to the HTTP handlers
+var APIKeys = &KeyStore{}
+
+// OpenKeyStore loads the keys saved at path, if there are any
+func OpenKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, keys: make(map[string]APIKey)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read the file again if it has changed; callers must hold the lock
+func (s *KeyStore) reload() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys, s.modTime = make(map[string]APIKey), time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	buf, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	saved := []APIKey{}
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	s.keys = make(map[string]APIKey, len(saved))
+	for _, k := range saved {
+		s.keys[k.Id] = k
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create a key and return the token to give to its user, which is the key's
+// Id and secret joined by a dot. The token is not stored anywhere.
+func (s *KeyStore) Create(name string, scope Scope, meters []string, now time.Time) (string, APIKey, error) {
+	if scope == AdminScope && len(meters) > 0 {
+		return "", APIKey{}, errors.New("admin keys can't be limited to meters")
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	key := APIKey{Id: id, Name: name, Scope: scope, Meters: meters, Hash: hashSecret(secret), Created: now}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return "", APIKey{}, err
+	}
+	if s.keys == nil {
+		s.keys = make(map[string]APIKey)
+	}
+	s.keys[id] = key
+	return id + "." + secret, key, s.save()
+}
+
+func (s *KeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrUnknownKeyId
+	}
+	if key.Scope == AdminScope {
+		admins := 0
+		for _, k := range s.keys {
+			if k.Scope == AdminScope {
+				admins++
+			}
+		}
+		// Without one nobody could manage the sinks or see the inventory
+		if admins == 1 {
+			return ErrLastAdminKey
+		}
+	}
+	delete(s.keys, id)
+	return s.save()
+}
+
+// List the keys ordered by when they were created
+func (s *KeyStore) List() ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s.list(), nil
+}
+
+// Callers must hold the lock
+func (s *KeyStore) list() []APIKey {
+	list := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Callers must hold the lock
+func (s *KeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := writeJSONFile(s.path, s.list()); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Verify a token in constant time. While there are no keys at all every token,
+// even an empty one, is treated as an admin key if the store is Open and
+// refused if it isn't.
+func (s *KeyStore) Verify(token string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return APIKey{}, err
+	}
+	if len(s.keys) == 0 {
+		if s.Open {
+			return APIKey{Scope: AdminScope}, nil
+		}
+		return APIKey{}, ErrNoKeys
+	}
+	if token == "" {
+		return APIKey{}, ErrNoAPIKey
+	}
+	id, secret := token, ""
+	if i := strings.Index(token, "."); i >= 0 {
+		id, secret = token[:i], token[i+1:]
+	}
+	key, ok := s.keys[id]
+	given, _ := hex.DecodeString(hashSecret(secret))
+	expected, _ := hex.DecodeString(key.Hash)
+	if subtle.ConstantTimeCompare(given, expected) != 1 || !ok {
+		return APIKey{}, ErrBadAPIKey
+	}
+	return key, nil
+}
+
+// Authorize checks the bearer token of a request has the scope asked for,
+// writing a 401 or 403 if it doesn't
+func (s *KeyStore) Authorize(w http.ResponseWriter, req *http.Request, scope Scope) (APIKey, bool) {
+	token := ""
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	key, err := s.Verify(token)
+	if err == ErrNoAPIKey || err == ErrBadAPIKey || err == ErrNoKeys {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="eagle"`)
+		w.WriteHeader(401)
+		w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+		return key, false
+	} else if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return key, false
+	}
+	if !key.allows(scope) {
+		w.WriteHeader(403)
+		w.Write([]byte(fmt.Sprintf("Error: key %s has %s scope", key.Id, key.Scope)))
+		return key, false
+	}
+	return key, true
+}
+
+// Require wraps a handler that can't limit what it serves to a key's meters,
+// so it is only open to keys with the scope that are allowed every meter
+func (s *KeyStore) Require(scope Scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, ok := s.Authorize(w, req, scope)
+		if !ok {
+			return
+		}
+		if len(key.Meters) > 0 {
+			w.WriteHeader(403)
+			w.Write([]byte(fmt.Sprintf("Error: key %s is limited to some meters", key.Id)))
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
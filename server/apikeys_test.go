@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The handler tests don't send API keys
+	APIKeys.Open = true
+	os.Exit(m.Run())
+}
+
+func getWithKey(handler http.Handler, path, token string) *httptest.ResponseRecorder {
+	record := httptest.NewRecorder()
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: path}, Header: http.Header{}}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	handler.ServeHTTP(record, req)
+	return record
+}
+
+func TestAPIKeys(t *testing.T) {
+	savedReadings, savedKeys := Readings, APIKeys
+	defer func() { Readings, APIKeys = savedReadings, savedKeys }()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Readings, APIKeys = NewMemoryStore(10), keys
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "InstantaneousDemand"))
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000005", "InstantaneousDemand"))
+	metrics := http.HandlerFunc(MetricsHandler)
+	sinks := APIKeys.Require(AdminScope, http.HandlerFunc(SinksHandler))
+
+	if record := getWithKey(metrics, "/metrics", ""); record.Code != 401 {
+		t.Errorf("Got %d with no keys created", record.Code)
+	}
+	keys.Open = true
+	if record := getWithKey(metrics, "/metrics", ""); record.Code != 200 {
+		t.Errorf("Got %d with no keys created on an open store", record.Code)
+	}
+
+	// Keys made by another process, like the keys command, are picked up
+	cli, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cli.Create("admin", AdminScope, []string{"00:17:8d:00:00:00:00:04"}, time.Now()); err == nil {
+		t.Errorf("Expected admin keys to be refused meters")
+	}
+	reader, key, err := cli.Create("neighbour", ReadScope, []string{"00:17:8d:00:00:00:00:04"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := cli.Create("admin", AdminScope, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		handler  http.Handler
+		token    string
+		expected int
+	}{
+		{metrics, "", 401},
+		{metrics, key.Id + ".nonsense", 401},
+		{metrics, "nonsense", 401},
+		{metrics, reader, 200},
+		{metrics, admin, 200},
+		{sinks, reader, 403},
+		{sinks, admin, 200},
+	}
+	for _, test := range tests {
+		if record := getWithKey(test.handler, "/metrics", test.token); record.Code != test.expected {
+			t.Errorf("Token %q got %d instead of %d", test.token, record.Code, test.expected)
+		}
+	}
+
+	readings := []Reading{}
+	record := getWithKey(metrics, "/metrics", reader)
+	if err := json.Unmarshal(record.Body.Bytes(), &readings); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(readings) != 1 || readings[0].Meter != "00:17:8d:00:00:00:00:04" {
+		t.Errorf("Expected only the allowed meter, got %s", record.Body)
+	}
+
+	if err := cli.Revoke(key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Revoke(key.Id); err != ErrUnknownKeyId {
+		t.Errorf("Revoking twice got %v", err)
+	}
+	if err := cli.Revoke(strings.SplitN(admin, ".", 2)[0]); err != ErrLastAdminKey {
+		t.Errorf("Revoking the last admin key got %v", err)
+	}
+	// Make sure the change is seen even on filesystems with coarse times
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if record := getWithKey(metrics, "/metrics", reader); record.Code != 401 {
+		t.Errorf("Revoked key got %d", record.Code)
+	}
+	list, err := APIKeys.List()
+	if err != nil || len(list) != 1 || list[0].Name != "admin" || list[0].Hash == "" {
+		t.Errorf("Got keys %+v, %v", list, err)
+	}
+}
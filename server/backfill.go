@@ -0,0 +1,368 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A HistorySource fetches the summation history an EAGLE has kept. Package
+// client provides one.
+type HistorySource interface {
+	HistoryData(start, end time.Time, frequency time.Duration) (HistoryDataFragment, error)
+}
+
+// A ProfileSource fetches interval data from a meter through its EAGLE.
+// Package client provides one.
+type ProfileSource interface {
+	ProfileData(meter MacAddrHex, periods int, end time.Time, channel string) (ProfileDataFragment, error)
+}
+
+// The most ProfileData requests made to fill one gap, each of up to 12
+// intervals
+const maxProfileRequests = 100
+
+// A Gap is a stretch of time with no summation from a meter, between two
+// readings of it
+type Gap struct {
+	Before Reading
+	After  Reading
+}
+
+// FindGaps looks for readings of each meter's summation that are more than
+// longest apart. The readings should be oldest first.
+func FindGaps(readings []Reading, longest time.Duration) []Gap {
+	gaps := []Gap{}
+	keys, meters := partition(readings)
+	for _, key := range keys {
+		var prev Reading
+		for _, r := range meters[key] {
+			if !reportsSummation(r) {
+				continue
+			}
+			if !prev.Time.IsZero() && r.Time.Sub(prev.Time) > longest {
+				gaps = append(gaps, Gap{prev, r})
+			}
+			prev = r
+		}
+	}
+	return gaps
+}
+
+// The readings to fill a gap with from the history of its meter. The history
+// only has the summation, so that is all they set.
+func (g Gap) readings(history HistoryDataFragment) []Reading {
+	readings := []Reading{}
+	for _, frag := range history.CurrentSummation {
+		if len(frag.MeterMacId) > 0 && frag.MeterMacId.String() != g.Before.Meter {
+			continue
+		}
+		s := CurrentSummation{CurrentSummation: frag}
+		if !s.Time().After(g.Before.Time) || !s.Time().Before(g.After.Time) {
+			continue
+		}
+		readings = append(readings, historyReading(g.Before.Key(), s))
+	}
+	return readings
+}
+
+// The readings to fill a gap with from the delivered energy in each interval,
+// oldest first. The summation is added up from the reading before the gap,
+// so energy used before the first whole interval is only counted at the end
+// of the gap, and it stops at the first invalid interval. The demand is the
+// average over the interval, and the received summation is carried forward.
+func (g Gap) intervalReadings(intervals []Interval) []Reading {
+	readings := []Reading{}
+	last, delivered := g.Before.Time, g.Before.Delivered
+	for _, interval := range intervals {
+		if interval.Start.Before(last) {
+			continue
+		}
+		if !interval.End.Before(g.After.Time) || !interval.Valid {
+			break
+		}
+		delivered += interval.Energy
+		readings = append(readings, Reading{
+			Time:      interval.End,
+			Gateway:   g.Before.Gateway,
+			Meter:     g.Before.Meter,
+			Demand:    Power(float64(interval.Energy) / interval.End.Sub(interval.Start).Hours()),
+			Delivered: delivered,
+			Received:  g.Before.Received,
+			Fragment:  "ProfileData",
+		})
+		last = interval.End
+	}
+	return readings
+}
+
+// BackfillResult is what happened to one gap
+type BackfillResult struct {
+	Gateway string    `json:"gateway"`
+	Meter   string    `json:"meter"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Fetched is how many points the EAGLE sent and Added how many of them
+	// were new
+	Fetched int `json:"fetched"`
+	Added   int `json:"added"`
+	// Source is history or profile for the command the points came from
+	Source string `json:"source,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A Backfiller fills gaps in the stored summation of meters with the history
+// kept by their EAGLEs, or if that doesn't cover a gap and the source is also
+// a ProfileSource, with the interval data kept by the meter. Fetching the same
+// history twice does no harm since readings already stored are skipped.
+type Backfiller struct {
+	// Gap is the longest time between summations that isn't a gap
+	Gap time.Duration
+	// Frequency is the interval of the history asked for
+	Frequency time.Duration
+
+	mu         sync.Mutex
+	sources    map[string]HistorySource
+	scales     map[MeterKey][2]HexInt
+	scalesPath string
+	last       []BackfillResult
+	running    bool
+}
+
+// The scale of a meter's summation as it is saved
+type meterScale struct {
+	Gateway    string `json:"gateway"`
+	Meter      string `json:"meter"`
+	Multiplier HexInt `json:"multiplier"`
+	Divisor    HexInt `json:"divisor"`
+}
+
+// Backfills fills gaps in Readings
+var Backfills = &Backfiller{Gap: 15 * time.Minute, Frequency: 5 * time.Minute}
+
+// BackfillLookback is how far back Run looks for gaps
+var BackfillLookback = 7 * 24 * time.Hour
+
+// AddGateway lets history be fetched from an EAGLE, keyed by the MacId of its
+// uploads
+func (b *Backfiller) AddGateway(gateway string, source HistorySource) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sources == nil {
+		b.sources = make(map[string]HistorySource)
+	}
+	b.sources[gateway] = source
+}
+
+// LoadScales reads the scales of the meters saved at path, if there are any,
+// and saves them there whenever one changes so they outlast a restart
+func (b *Backfiller) LoadScales(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scalesPath = path
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := []meterScale{}
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	b.scales = make(map[MeterKey][2]HexInt, len(saved))
+	for _, s := range saved {
+		b.scales[MeterKey{s.Gateway, s.Meter}] = [2]HexInt{s.Multiplier, s.Divisor}
+	}
+	return nil
+}
+
+// SetScale records the multiplier and divisor of a meter's summation, which
+// its interval data is scaled by too
+func (b *Backfiller) SetScale(key MeterKey, multiplier, divisor HexInt) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.scales == nil {
+		b.scales = make(map[MeterKey][2]HexInt)
+	}
+	scale := [2]HexInt{multiplier, divisor}
+	if old, ok := b.scales[key]; ok && old == scale {
+		return nil
+	}
+	b.scales[key] = scale
+	if b.scalesPath == "" {
+		return nil
+	}
+	saved := []meterScale{}
+	for k, s := range b.scales {
+		saved = append(saved, meterScale{k.Gateway, k.Meter, s[0], s[1]})
+	}
+	return writeJSONFile(b.scalesPath, saved)
+}
+
+// The multiplier and divisor to scale a meter's interval data by
+func (b *Backfiller) scale(key MeterKey) ([2]HexInt, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	scale, ok := b.scales[key]
+	if !ok {
+		return scale, fmt.Errorf("no summation from meter %s to scale its intervals by", key.Meter)
+	}
+	return scale, nil
+}
+
+// ProfileReadings gives the readings to store from profile data an EAGLE
+// uploaded, added up from the meter's summation before the intervals as when
+// filling a gap. Intervals from the next summation on are left out.
+func (b *Backfiller) ProfileReadings(store Store, gateway string, profile ProfileDataFragment) ([]Reading, error) {
+	key := MeterKey{gateway, profile.MeterMacId.String()}
+	scale, err := b.scale(key)
+	if err != nil {
+		return nil, err
+	}
+	intervals, err := profile.Intervals(scale[0], scale[1])
+	if err != nil || len(intervals) == 0 {
+		return nil, err
+	}
+	start, end := intervals[0].Start, intervals[len(intervals)-1].End
+	gap := Gap{After: Reading{Time: end.Add(time.Nanosecond)}}
+	for _, r := range store.Range(start.Add(-BackfillLookback), time.Time{}) {
+		if r.Key() != key || !reportsSummation(r) {
+			continue
+		}
+		if !r.Time.After(start) {
+			gap.Before = r
+		} else if !gap.Before.Time.IsZero() {
+			gap.After = r
+			break
+		}
+	}
+	if gap.Before.Time.IsZero() {
+		return nil, fmt.Errorf("no summation from meter %s before %s to add its intervals to", key.Meter, start)
+	}
+	return gap.intervalReadings(intervals), nil
+}
+
+// Fetch the meter's intervals back from the end of the gap until they cover
+// it. Returns the readings made from them and how many intervals there were.
+func (b *Backfiller) profileReadings(source ProfileSource, gap Gap) ([]Reading, int, error) {
+	scale, err := b.scale(gap.Before.Key())
+	if err != nil {
+		return nil, 0, err
+	}
+	meter, err := net.ParseMAC(gap.Before.Meter)
+	if err != nil {
+		return nil, 0, err
+	}
+	intervals := []Interval{}
+	end := gap.After.Time
+	for i := 0; i < maxProfileRequests && end.After(gap.Before.Time); i++ {
+		profile, err := source.ProfileData(MacAddrHex(meter), 12, end, "Delivered")
+		if err != nil {
+			return nil, len(intervals), err
+		}
+		if profile.Status == 0x05 {
+			// Nothing older
+			break
+		}
+		batch, err := profile.Intervals(scale[0], scale[1])
+		if err != nil {
+			return nil, len(intervals), err
+		}
+		if len(batch) == 0 || !batch[0].Start.Before(end) {
+			break
+		}
+		intervals = append(batch, intervals...)
+		end = batch[0].Start
+	}
+	return gap.intervalReadings(intervals), len(intervals), nil
+}
+
+// Fill the gaps between from and to in the store that there is a source of
+// history for
+func (b *Backfiller) Fill(store Store, from, to time.Time) []BackfillResult {
+	results := []BackfillResult{}
+	for _, gap := range FindGaps(store.Range(from, to), b.Gap) {
+		b.mu.Lock()
+		source, ok := b.sources[gap.Before.Gateway]
+		b.mu.Unlock()
+		if !ok {
+			continue
+		}
+		result := BackfillResult{
+			Gateway: gap.Before.Gateway,
+			Meter:   gap.Before.Meter,
+			Start:   gap.Before.Time,
+			End:     gap.After.Time,
+		}
+		var readings []Reading
+		history, err := source.HistoryData(gap.Before.Time, gap.After.Time, b.Frequency)
+		if err == nil {
+			result.Fetched, result.Source = len(history.CurrentSummation), "history"
+			readings = gap.readings(history)
+		}
+		if profile, ok := source.(ProfileSource); ok && len(readings) == 0 {
+			var fetched int
+			var perr error
+			if readings, fetched, perr = b.profileReadings(profile, gap); perr == nil || err == nil {
+				result.Fetched, result.Source, err = fetched, "profile", perr
+			}
+		}
+		if err == nil {
+			result.Added, err = store.Merge(readings)
+		}
+		if err != nil {
+			log.Printf("Backfilling %s %s from %s to %s: %v", result.Gateway, result.Meter, result.Start, result.End, err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	b.mu.Lock()
+	b.last = results
+	b.mu.Unlock()
+	return results
+}
+
+// Start fills the gaps between from and to in the background, unless a fill
+// started this way is still running. Last gives the results once it is done.
+func (b *Backfiller) Start(store Store, from, to time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		return false
+	}
+	b.running = true
+	go func() {
+		b.Fill(store, from, to)
+		b.mu.Lock()
+		b.running = false
+		b.mu.Unlock()
+	}()
+	return true
+}
+
+// Last gives the results of the last Fill
+func (b *Backfiller) Last() []BackfillResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BackfillResult{}, b.last...)
+}
+
+// Run fills the gaps in the last BackfillLookback of the store straight away
+// and then periodically until stop is closed
+func (b *Backfiller) Run(store Store, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		b.Fill(store, time.Now().Add(-BackfillLookback), time.Time{})
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
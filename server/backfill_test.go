@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A HistorySource with the summation going up by 0.01kWh a minute
+type fakeHistory struct {
+	requests int
+	fail     bool
+}
+
+func (h *fakeHistory) HistoryData(start, end time.Time, frequency time.Duration) (HistoryDataFragment, error) {
+	h.requests++
+	if h.fail {
+		return HistoryDataFragment{}, errors.New("timed out")
+	}
+	history := HistoryDataFragment{}
+	for t := start.Truncate(frequency); !t.After(end); t = t.Add(frequency) {
+		history.CurrentSummation = append(history.CurrentSummation, CurrentSummationFragment{
+			MeterMacId:         MacAddrHex{0x00, 0x17, 0x8d, 0x00, 0x00, 0x00, 0x00, 0x04},
+			TimeStamp:          NewEagleTime(t),
+			SummationDelivered: HexInt(1000 + t.Sub(backfillStart)/time.Minute*10),
+			Divisor:            1000,
+		})
+	}
+	return history, nil
+}
+
+// A HistorySource with no history and a ProfileSource with the meter using
+// 0.05kWh every five minutes
+type fakeProfile struct {
+	requests []time.Time
+}
+
+func (p *fakeProfile) HistoryData(start, end time.Time, frequency time.Duration) (HistoryDataFragment, error) {
+	return HistoryDataFragment{}, nil
+}
+
+func (p *fakeProfile) ProfileData(meter MacAddrHex, periods int, end time.Time, channel string) (ProfileDataFragment, error) {
+	p.requests = append(p.requests, end)
+	end = end.Truncate(5 * time.Minute)
+	profile := ProfileDataFragment{MeterMacId: meter, EndTime: NewEagleTime(end), ProfileIntervalPeriod: 6}
+	if end.Before(backfillStart) {
+		profile.Status = 0x05
+		return profile, nil
+	}
+	for i := 0; i < periods; i++ {
+		profile.IntervalData = append(profile.IntervalData, 50)
+	}
+	profile.NumberOfPeriodsDelivered = HexInt(periods)
+	return profile, nil
+}
+
+var backfillStart = time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func summationReading(gateway string, minutes int) Reading {
+	return Reading{
+		Time:      backfillStart.Add(time.Duration(minutes) * time.Minute),
+		Gateway:   gateway,
+		Meter:     "00:17:8d:00:00:00:00:04",
+		Demand:    0.6,
+		Tier:      1,
+		Delivered: Energy(1 + float64(minutes)/100),
+	}
+}
+
+func TestFindGaps(t *testing.T) {
+	readings := []Reading{
+		summationReading("f0:ad:4e:00:ce:69", 0),
+		summationReading("f0:ad:4e:00:ce:70", 0),
+		summationReading("f0:ad:4e:00:ce:69", 5),
+		// Demand readings carry the summation forward but don't report it
+		{Time: backfillStart.Add(20 * time.Minute), Gateway: "f0:ad:4e:00:ce:69", Meter: "00:17:8d:00:00:00:00:04", Demand: 1, Delivered: 1.05, Fragment: "InstantaneousDemand"},
+		summationReading("f0:ad:4e:00:ce:70", 10),
+		summationReading("f0:ad:4e:00:ce:69", 30),
+		summationReading("f0:ad:4e:00:ce:69", 35),
+	}
+	gaps := FindGaps(readings, 15*time.Minute)
+	if len(gaps) != 1 || !gaps[0].Before.Time.Equal(backfillStart.Add(5*time.Minute)) || !gaps[0].After.Time.Equal(backfillStart.Add(30*time.Minute)) {
+		t.Errorf("Got gaps %+v", gaps)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	store := NewMemoryStore(100)
+	for _, m := range []int{0, 5, 60, 65} {
+		store.Append(summationReading("f0:ad:4e:00:ce:69", m))
+		store.Append(summationReading("f0:ad:4e:00:ce:70", m))
+	}
+	history := &fakeHistory{}
+	b := &Backfiller{Gap: 15 * time.Minute, Frequency: 5 * time.Minute}
+	b.AddGateway("f0:ad:4e:00:ce:69", history)
+
+	results := b.Fill(store, time.Time{}, time.Time{})
+	if len(results) != 1 || results[0].Fetched != 12 || results[0].Added != 10 || history.requests != 1 {
+		t.Fatalf("Got results %+v", results)
+	}
+	filled := Query{Gateway: "f0:ad:4e:00:ce:69"}.Filter(store.Range(time.Time{}, time.Time{}))
+	if len(filled) != 14 {
+		t.Fatalf("Got %d readings instead of 14", len(filled))
+	}
+	for i, r := range filled {
+		if !r.Time.Equal(backfillStart.Add(time.Duration(i*5)*time.Minute)) || math.Abs(float64(r.Delivered)-1-float64(i)*0.05) > 1e-9 {
+			t.Errorf("Reading %d is %+v", i, r)
+		}
+		// The history says nothing of the demand or price
+		if backfilled := i > 1 && i < 12; backfilled && (r.Fragment != "HistoryData" || r.Demand != 0 || r.Tier != 0) || !backfilled && r.Tier != 1 {
+			t.Errorf("Reading %d is %+v", i, r)
+		}
+	}
+
+	// Filled gaps aren't gaps any more
+	if results := b.Fill(store, time.Time{}, time.Time{}); len(results) != 0 || history.requests != 1 {
+		t.Errorf("Got results %+v filling again", results)
+	}
+	// and filling them twice adds nothing
+	gap := Gap{summationReading("f0:ad:4e:00:ce:69", 5), summationReading("f0:ad:4e:00:ce:69", 60)}
+	h, _ := history.HistoryData(gap.Before.Time, gap.After.Time, 5*time.Minute)
+	if n, _ := store.Merge(gap.readings(h)); n != 0 {
+		t.Errorf("Merged %d readings the second time", n)
+	}
+}
+
+func TestBackfillProfile(t *testing.T) {
+	store := NewMemoryStore(100)
+	for _, m := range []int{0, 5, 60, 65} {
+		store.Append(summationReading("f0:ad:4e:00:ce:69", m))
+	}
+	profile := &fakeProfile{}
+	b := &Backfiller{Gap: 15 * time.Minute, Frequency: 5 * time.Minute}
+	b.AddGateway("f0:ad:4e:00:ce:69", profile)
+
+	// The intervals can't be scaled until a summation has been received
+	results := b.Fill(store, time.Time{}, time.Time{})
+	if len(results) != 1 || results[0].Error == "" || len(profile.requests) != 0 {
+		t.Fatalf("Got results %+v without a scale", results)
+	}
+
+	b.SetScale(MeterKey{"f0:ad:4e:00:ce:69", "00:17:8d:00:00:00:00:04"}, 1, 1000)
+	results = b.Fill(store, time.Time{}, time.Time{})
+	if len(results) != 1 || results[0].Source != "profile" || results[0].Fetched != 12 || results[0].Added != 10 || results[0].Error != "" {
+		t.Fatalf("Got results %+v", results)
+	}
+	if len(profile.requests) != 1 || !profile.requests[0].Equal(backfillStart.Add(time.Hour)) {
+		t.Errorf("Got requests ending %v", profile.requests)
+	}
+	filled := store.Range(time.Time{}, time.Time{})
+	if len(filled) != 14 {
+		t.Fatalf("Got %d readings instead of 14", len(filled))
+	}
+	for i, r := range filled {
+		expected := summationReading("f0:ad:4e:00:ce:69", i*5)
+		if !r.Time.Equal(expected.Time) || math.Abs(float64(r.Delivered-expected.Delivered)) > 1e-9 || math.Abs(float64(r.Demand-expected.Demand)) > 1e-9 {
+			t.Errorf("Reading %d is %+v instead of %+v", i, r, expected)
+		}
+	}
+}
+
+func TestProfileDataRequest(t *testing.T) {
+	savedReadings, savedBackfills := Readings, Backfills
+	defer func() { Readings, Backfills = savedReadings, savedBackfills }()
+	Readings, Backfills = NewMemoryStore(100), &Backfiller{Gap: 15 * time.Minute, Frequency: 5 * time.Minute}
+	Readings.Append(summationReading("f0:ad:4e:00:ce:69", 5))
+	Readings.Append(summationReading("f0:ad:4e:00:ce:69", 60))
+	end, _ := NewEagleTime(backfillStart.Add(15 * time.Minute)).MarshalText()
+	body := `<rainforest macId="0xf0ad4e00ce69">
+  <ProfileData>
+    <MeterMacId>0x00178d0000000004</MeterMacId>
+    <EndTime>` + string(end) + `</EndTime>
+    <Status>0x00</Status>
+    <ProfileIntervalPeriod>0x06</ProfileIntervalPeriod>
+    <NumberOfPeriodsDelivered>0x02</NumberOfPeriodsDelivered>
+    <IntervalData1>0x000032</IntervalData1>
+    <IntervalData2>0x000032</IntervalData2>
+  </ProfileData>
+</rainforest>`
+
+	// Without a summation to scale them by the intervals are skipped
+	postFragment(t, body)
+	if readings := Readings.Range(time.Time{}, time.Time{}); len(readings) != 2 {
+		t.Fatalf("Got %+v without a scale", readings)
+	}
+
+	Backfills.SetScale(MeterKey{"f0:ad:4e:00:ce:69", "00:17:8d:00:00:00:00:04"}, 1, 1000)
+	postFragment(t, body)
+	readings := Readings.Range(time.Time{}, time.Time{})
+	if len(readings) != 4 {
+		t.Fatalf("Got %d readings instead of 4: %+v", len(readings), readings)
+	}
+	for i, r := range readings[1:3] {
+		expected := summationReading("f0:ad:4e:00:ce:69", 10+i*5)
+		if r.Fragment != "ProfileData" || !r.Time.Equal(expected.Time) || math.Abs(float64(r.Delivered-expected.Delivered)) > 1e-9 || math.Abs(float64(r.Demand-expected.Demand)) > 1e-9 || r.Tier != 0 {
+			t.Errorf("Reading %d is %+v instead of %+v", i, r, expected)
+		}
+	}
+}
+
+func TestBackfillerScales(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scales.json")
+	key := MeterKey{"f0:ad:4e:00:ce:69", "00:17:8d:00:00:00:00:04"}
+	b := &Backfiller{}
+	if err := b.LoadScales(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetScale(key, 1, 1000); err != nil {
+		t.Fatal(err)
+	}
+	// The scale is known after a restart, but only for that gateway
+	restarted := &Backfiller{}
+	if err := restarted.LoadScales(path); err != nil {
+		t.Fatal(err)
+	}
+	if scale, err := restarted.scale(key); err != nil || scale != [2]HexInt{1, 1000} {
+		t.Errorf("Got scale %v, %v after a restart", scale, err)
+	}
+	if _, err := restarted.scale(MeterKey{"f0:ad:4e:00:ce:70", key.Meter}); err == nil {
+		t.Errorf("Expected no scale through another gateway")
+	}
+}
+
+func TestPostBackfill(t *testing.T) {
+	savedReadings, savedBackfills := Readings, Backfills
+	defer func() { Readings, Backfills = savedReadings, savedBackfills }()
+	Readings, Backfills = NewMemoryStore(100), &Backfiller{Gap: 15 * time.Minute, Frequency: 5 * time.Minute}
+	Backfills.AddGateway("f0:ad:4e:00:ce:69", &fakeHistory{fail: true})
+	Readings.Append(summationReading("f0:ad:4e:00:ce:69", 0))
+	Readings.Append(summationReading("f0:ad:4e:00:ce:69", 60))
+
+	record := httptest.NewRecorder()
+	BackfillHandler(record, &http.Request{Method: "POST", URL: &url.URL{Path: "/backfill", RawQuery: "from=2014-01-01T00:00:00Z"}})
+	if record.Code != 202 {
+		t.Fatalf("Got %d %s", record.Code, record.Body)
+	}
+	waitFor(t, "the backfill", func() bool { return len(Backfills.Last()) > 0 })
+
+	record = httptest.NewRecorder()
+	BackfillHandler(record, &http.Request{Method: "GET", URL: &url.URL{Path: "/backfill"}})
+	results := []BackfillResult{}
+	if err := json.Unmarshal(record.Body.Bytes(), &results); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(results) != 1 || results[0].Error != "timed out" || results[0].Added != 0 {
+		t.Errorf("Got %s from the last run", record.Body)
+	}
+}
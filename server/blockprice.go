@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// A BlockPriceTracker holds the block pricing most recently reported for each
+// meter
+type BlockPriceTracker struct {
+	mu     sync.Mutex
+	latest map[MeterKey]BlockStatus
+}
+
+// BlockPrices is updated by the HTTP handlers
+var BlockPrices = &BlockPriceTracker{}
+
+func (t *BlockPriceTracker) Set(key MeterKey, status BlockStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latest == nil {
+		t.latest = make(map[MeterKey]BlockStatus)
+	}
+	if old, ok := t.latest[key]; ok && status.Time.Before(old.Time) {
+		return
+	}
+	t.latest[key] = status
+}
+
+// All gives the status of each meter ordered by gateway and meter
+func (t *BlockPriceTracker) All() []BlockStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]MeterKey, 0, len(t.latest))
+	for key := range t.latest {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Gateway != keys[j].Gateway {
+			return keys[i].Gateway < keys[j].Gateway
+		}
+		return keys[i].Meter < keys[j].Meter
+	})
+	all := make([]BlockStatus, len(keys))
+	for i, key := range keys {
+		all[i] = t.latest[key]
+	}
+	return all
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// BillingDay is the day of the month, 1 to 28, that billing periods start on
+var BillingDay = 1
+
+// A CostPeriod is how costs are grouped. Periods start on the hour, at
+// midnight or on the BillingDay in local time.
+type CostPeriod string
+
+const (
+	Hourly  CostPeriod = "hour"
+	Daily   CostPeriod = "day"
+	Billing CostPeriod = "billing"
+)
+
+var CostPeriods = []CostPeriod{Hourly, Daily, Billing}
+
+func ParseCostPeriod(s string) (CostPeriod, error) {
+	for _, p := range CostPeriods {
+		if s == string(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown period %q", s)
+}
+
+// Start of the period that t is in
+func (p CostPeriod) Start(t time.Time) time.Time {
+	t = t.In(time.Local)
+	year, month, day := t.Date()
+	switch p {
+	case Hourly:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, time.Local)
+	case Daily:
+		return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+	}
+	start := time.Date(year, month, BillingDay, 0, 0, 0, 0, time.Local)
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// End of the period beginning at start
+func (p CostPeriod) End(start time.Time) time.Time {
+	switch p {
+	case Hourly:
+		return start.Add(time.Hour)
+	case Daily:
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// TierCost is the energy used at one price and what it cost
+type TierCost struct {
+	Tier   int    `json:"tier"`
+	Rate   string `json:"rate,omitempty"`
+	Price  Price  `json:"price"`
+	Energy Energy `json:"energy"`
+	Cost   Money  `json:"cost"`
+}
+
+// Cost is the energy used in a period and what it cost, broken down by the
+// prices in effect during it
+type Cost struct {
+	Gateway string     `json:"gateway,omitempty"`
+	Meter   string     `json:"meter,omitempty"`
+	Period  CostPeriod `json:"period"`
+	Start   time.Time  `json:"start"`
+	End     time.Time  `json:"end"`
+	Energy  Energy     `json:"energy"`
+	Cost    Money      `json:"cost"`
+	Tiers   []TierCost `json:"tiers"`
+}
+
+// A CostAccumulator works out the cost of energy from the readings of one
+// meter. Between readings the demand last reported is held and charged at the
+// price, tier and rate last reported, split between periods at their
+// boundaries. Once the meter has reported its summation that is only an
+// estimate: when it next reports it, the change in net summation since is
+// spread over the time between them in proportion to the estimated demand,
+// and charged at the prices in effect then. Energy used before any price is
+// known costs nothing.
+//
+// Readings should be added oldest first. A summation that arrives late is
+// still counted, but late demand and price readings are dropped, as they would
+// only change how the energy between summations is spread.
+type CostAccumulator struct {
+	Period CostPeriod
+	// Limit is the most periods kept, oldest dropped first; 0 keeps them all
+	Limit int
+
+	// last holds the latest value of each series reported so far
+	last Reading
+	// summation is the latest reading that reported the summation
+	summation Reading
+	// pending are the spans since summation, only charged at their estimate
+	// until the next one settles them
+	pending []costSpan
+	costs   []Cost
+}
+
+// A costSpan is the time between two readings with the demand and price in
+// effect during it
+type costSpan struct {
+	start, end time.Time
+	at         Reading
+	estimate   float64
+}
+
+// maxPendingSpans bounds the spans waiting for a summation. If the meter stops
+// reporting it, past this the estimates are kept as they are.
+const maxPendingSpans = 4096
+
+func (a *CostAccumulator) Add(r Reading) {
+	switch {
+	case a.last.Time.IsZero():
+	case r.Time.Before(a.last.Time):
+		if reportsSummation(r) && !a.summation.Time.IsZero() && r.Time.After(a.summation.Time) {
+			a.settle(r)
+		}
+		return
+	case r.Time.After(a.last.Time):
+		span := costSpan{start: a.last.Time, end: r.Time, at: a.last}
+		span.estimate = float64(a.last.Demand) * r.Time.Sub(a.last.Time).Hours()
+		if a.summation.Time.IsZero() {
+			a.costs = a.chargeSpan(a.costs, span, span.estimate)
+		} else {
+			a.pending = append(a.pending, span)
+		}
+	}
+	a.carryForward(r)
+	if reportsSummation(r) {
+		a.settle(r)
+	}
+	if len(a.pending) > maxPendingSpans {
+		for _, span := range a.pending {
+			a.costs = a.chargeSpan(a.costs, span, span.estimate)
+		}
+		a.pending, a.summation = nil, Reading{}
+	}
+}
+
+// carryForward takes on the values that r reports
+func (a *CostAccumulator) carryForward(r Reading) {
+	last := a.last
+	a.last = r
+	if !r.Sets("demand") {
+		a.last.Demand = last.Demand
+	}
+	if !r.Sets("price") {
+		a.last.Price, a.last.Tier, a.last.Rate = last.Price, last.Tier, last.Rate
+	}
+}
+
+// settle charges the change in net summation between the last summation and
+// r to the pending spans before r, splitting the one r falls in
+func (a *CostAccumulator) settle(r Reading) {
+	if a.summation.Time.IsZero() {
+		a.summation = r
+		return
+	}
+	n := 0
+	for n < len(a.pending) && !a.pending[n].end.After(r.Time) {
+		n++
+	}
+	if n < len(a.pending) && a.pending[n].start.Before(r.Time) {
+		span := a.pending[n]
+		before, after := span, span
+		before.end, after.start = r.Time, r.Time
+		before.estimate = span.estimate * float64(r.Time.Sub(span.start)) / float64(span.end.Sub(span.start))
+		after.estimate = span.estimate - before.estimate
+		a.pending = append(a.pending[:n], append([]costSpan{before, after}, a.pending[n+1:]...)...)
+		n++
+	}
+	settled := a.pending[:n]
+	weight := func(span costSpan) float64 { return math.Abs(span.estimate) }
+	total := 0.0
+	for _, span := range settled {
+		total += weight(span)
+	}
+	if total == 0 {
+		// No demand was reported, so spread it evenly over the time
+		weight = func(span costSpan) float64 { return float64(span.end.Sub(span.start)) }
+		for _, span := range settled {
+			total += weight(span)
+		}
+	}
+	energy := float64(r.Delivered-r.Received) - float64(a.summation.Delivered-a.summation.Received)
+	for _, span := range settled {
+		a.costs = a.chargeSpan(a.costs, span, energy*weight(span)/total)
+	}
+	a.pending = append([]costSpan(nil), a.pending[n:]...)
+	a.summation = r
+}
+
+// reportsSummation is whether r is a reading of the meter's summation rather
+// than one carrying it forward
+func reportsSummation(r Reading) bool {
+	return r.Sets("delivered") && hasSummation(r)
+}
+
+func hasSummation(r Reading) bool {
+	return r.Delivered != 0 || r.Received != 0
+}
+
+// chargeSpan charges energy to costs spread evenly over a span
+func (a *CostAccumulator) chargeSpan(costs []Cost, span costSpan, energy float64) []Cost {
+	total := span.end.Sub(span.start)
+	for t := span.start; t.Before(span.end); {
+		start := a.Period.Start(t)
+		end := a.Period.End(start)
+		until := end
+		if until.After(span.end) {
+			until = span.end
+		}
+		costs = a.charge(costs, start, end, span.at, energy*float64(until.Sub(t))/float64(total))
+		t = until
+	}
+	return costs
+}
+
+func (a *CostAccumulator) charge(costs []Cost, start, end time.Time, r Reading, energy float64) []Cost {
+	i := len(costs) - 1
+	for i >= 0 && costs[i].Start.After(start) {
+		i--
+	}
+	if i < 0 || !costs[i].Start.Equal(start) {
+		if i < len(costs)-1 {
+			// The period has already been dropped
+			return costs
+		}
+		costs = append(costs, Cost{Gateway: r.Gateway, Meter: r.Meter, Period: a.Period, Start: start, End: end})
+		i = len(costs) - 1
+	}
+	a.chargeTier(&costs[i], r, energy)
+	if a.Limit > 0 && len(costs) > a.Limit {
+		costs = costs[len(costs)-a.Limit:]
+	}
+	return costs
+}
+
+func (a *CostAccumulator) chargeTier(cost *Cost, r Reading, energy float64) {
+	for i := range cost.Tiers {
+		tier := &cost.Tiers[i]
+		if tier.Tier == r.Tier && tier.Rate == r.Rate && tier.Price == r.Price {
+			tier.Energy += Energy(energy)
+			return
+		}
+	}
+	cost.Tiers = append(cost.Tiers, TierCost{Tier: r.Tier, Rate: r.Rate, Price: r.Price, Energy: Energy(energy)})
+}
+
+// Costs gives the cost of each period so far, oldest first. The last one is
+// usually still in progress, and any since the meter last reported its
+// summation are estimates.
+func (a *CostAccumulator) Costs() []Cost {
+	costs := make([]Cost, len(a.costs))
+	for i, c := range a.costs {
+		c.Tiers = append([]TierCost(nil), c.Tiers...)
+		costs[i] = c
+	}
+	for _, span := range a.pending {
+		costs = a.chargeSpan(costs, span, span.estimate)
+	}
+	for i := range costs {
+		c := &costs[i]
+		c.Energy = 0
+		c.Cost = Money{}
+		for j := range c.Tiers {
+			tier := &c.Tiers[j]
+			tier.Cost = tier.Price.Cost(tier.Energy)
+			c.Energy += tier.Energy
+			c.Cost = c.Cost.Add(tier.Cost)
+		}
+	}
+	return costs
+}
+
+// A CostTracker keeps the running cost of the current hour, day and billing
+// period of each meter as readings arrive
+type CostTracker struct {
+	mu     sync.Mutex
+	meters map[MeterKey][]*CostAccumulator
+}
+
+// Costs tracks the readings received by the HTTP handlers
+var Costs = NewCostTracker()
+
+func NewCostTracker() *CostTracker {
+	return &CostTracker{meters: make(map[MeterKey][]*CostAccumulator)}
+}
+
+// Add readings and return the cost so far of the current hour, day and
+// billing period of the last one's meter
+func (c *CostTracker) Add(readings ...Reading) []Cost {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var accumulators []*CostAccumulator
+	for _, r := range readings {
+		accumulators = c.meters[r.Key()]
+		if accumulators == nil {
+			for _, p := range CostPeriods {
+				accumulators = append(accumulators, &CostAccumulator{Period: p, Limit: 1})
+			}
+			c.meters[r.Key()] = accumulators
+		}
+		for _, a := range accumulators {
+			a.Add(r)
+		}
+	}
+	costs := []Cost{}
+	for _, a := range accumulators {
+		costs = append(costs, a.Costs()...)
+	}
+	return costs
+}
+
+// CostReport works out the cost of each period for each meter from readings
+// that are oldest first
+func CostReport(period CostPeriod, readings []Reading) []Cost {
+	costs := []Cost{}
+	keys, meters := partition(readings)
+	for _, key := range keys {
+		a := CostAccumulator{Period: period}
+		for _, r := range meters[key] {
+			a.Add(r)
+		}
+		costs = append(costs, a.Costs()...)
+	}
+	return costs
+}
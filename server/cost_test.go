@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var costStart = time.Date(2014, time.January, 1, 10, 30, 0, 0, time.UTC)
+
+func costReadings() []Reading {
+	cheap := Price{Money{1000, 4, cad}}
+	dear := Price{Money{2000, 4, cad}}
+	return []Reading{
+		{Time: costStart, Demand: 2, Price: cheap, Tier: 1, Rate: "Off peak"},
+		{Time: costStart.Add(time.Hour), Demand: 2, Price: cheap, Tier: 1, Rate: "Off peak"},
+		// The price changes at the same moment as a demand reading
+		{Time: costStart.Add(time.Hour), Demand: 2, Price: dear, Tier: 2, Rate: "On peak"},
+		{Time: costStart.Add(90 * time.Minute), Demand: 2, Price: dear, Tier: 2, Rate: "On peak"},
+	}
+}
+
+func TestCostAccumulatorDemand(t *testing.T) {
+	defer func(saved *time.Location) { time.Local = saved }(time.Local)
+	time.Local = time.UTC
+	a := CostAccumulator{Period: Hourly}
+	for _, r := range costReadings() {
+		a.Add(r)
+	}
+	costs := a.Costs()
+	if len(costs) != 2 {
+		t.Fatalf("Got %d periods instead of 2: %+v", len(costs), costs)
+	}
+	expected := []struct {
+		start  time.Time
+		energy Energy
+		cost   string
+		tiers  int
+	}{
+		{time.Date(2014, time.January, 1, 10, 0, 0, 0, time.UTC), 1, "0.10 CAD", 1},
+		{time.Date(2014, time.January, 1, 11, 0, 0, 0, time.UTC), 2, "0.30 CAD", 2},
+	}
+	for i, e := range expected {
+		c := costs[i]
+		if !c.Start.Equal(e.start) || !c.End.Equal(e.start.Add(time.Hour)) {
+			t.Errorf("Period %d is %v to %v", i, c.Start, c.End)
+		}
+		if c.Energy != e.energy || c.Cost.Rescale(2).String() != e.cost || len(c.Tiers) != e.tiers {
+			t.Errorf("Period %d: got %v for %v in %d tiers instead of %v for %v in %d", i, c.Cost, c.Energy, len(c.Tiers), e.cost, e.energy, e.tiers)
+		}
+	}
+	if tier := costs[1].Tiers[1]; tier.Tier != 2 || tier.Rate != "On peak" || tier.Energy != 1 {
+		t.Errorf("Got %+v for the on peak tier", tier)
+	}
+}
+
+func TestCostAccumulatorSummation(t *testing.T) {
+	price := Price{Money{1000, 4, cad}}
+	a := CostAccumulator{Period: Billing}
+	// The demand readings in between carry the summation forward, so all of
+	// the change is charged when the meter reports it
+	for i, delivered := range []Energy{100, 100, 100, 103} {
+		a.Add(Reading{Time: costStart.Add(time.Duration(i) * 20 * time.Minute), Demand: 50, Price: price, Delivered: delivered, Received: 1})
+	}
+	costs := a.Costs()
+	if len(costs) != 1 || costs[0].Energy != 3 || costs[0].Cost.Rescale(2).String() != "0.30 CAD" {
+		t.Errorf("Got %+v instead of 3kWh for 0.30 CAD", costs)
+	}
+}
+
+func TestCostAccumulatorSpreadsSummation(t *testing.T) {
+	defer func(saved *time.Location) { time.Local = saved }(time.Local)
+	time.Local = time.UTC
+	cheap := Price{Money{1000, 4, cad}}
+	dear := Price{Money{2000, 4, cad}}
+	a := CostAccumulator{Period: Hourly}
+	for _, r := range []Reading{
+		{Time: costStart, Price: cheap, Tier: 1, Fragment: "PriceCluster"},
+		{Time: costStart, Delivered: 100, Fragment: "CurrentSummation"},
+		{Time: costStart, Demand: 1, Fragment: "InstantaneousDemand"},
+		{Time: costStart.Add(30 * time.Minute), Price: dear, Tier: 2, Fragment: "PriceCluster"},
+		{Time: costStart.Add(30 * time.Minute), Demand: 3, Fragment: "InstantaneousDemand"},
+	} {
+		a.Add(r)
+	}
+	// Until the next summation the demand is all there is to go on
+	if costs := a.Costs(); len(costs) != 1 || costs[0].Energy != 0.5 || costs[0].Cost.Rescale(2).String() != "0.05 CAD" {
+		t.Errorf("Got %+v instead of an estimate of 0.5kWh for 0.05 CAD", costs)
+	}
+	a.Add(Reading{Time: costStart.Add(time.Hour), Delivered: 104, Fragment: "CurrentSummation"})
+	costs := a.Costs()
+	if len(costs) != 2 {
+		t.Fatalf("Got %d periods instead of 2: %+v", len(costs), costs)
+	}
+	// The 4kWh is spread 1:3 as the demand was, at the price in effect
+	for i, e := range []struct {
+		energy Energy
+		cost   string
+	}{{1, "0.10 CAD"}, {3, "0.60 CAD"}} {
+		if costs[i].Energy != e.energy || costs[i].Cost.Rescale(2).String() != e.cost {
+			t.Errorf("Period %d: got %v for %v instead of %v for %v", i, costs[i].Cost, costs[i].Energy, e.cost, e.energy)
+		}
+	}
+}
+
+func TestCostAccumulatorLateReadings(t *testing.T) {
+	defer func(saved *time.Location) { time.Local = saved }(time.Local)
+	time.Local = time.UTC
+	price := Price{Money{1000, 4, cad}}
+	a := CostAccumulator{Period: Hourly}
+	for _, r := range []Reading{
+		{Time: costStart, Price: price, Tier: 1, Fragment: "PriceCluster"},
+		{Time: costStart, Delivered: 100, Fragment: "CurrentSummation"},
+		{Time: costStart, Demand: 2, Fragment: "InstantaneousDemand"},
+		{Time: costStart.Add(time.Hour), Demand: 2, Fragment: "InstantaneousDemand"},
+		// A summation from before the last reading is still counted
+		{Time: costStart.Add(15 * time.Minute), Delivered: 103, Fragment: "CurrentSummation"},
+		// But a late demand reading is dropped
+		{Time: costStart.Add(30 * time.Minute), Demand: 100, Fragment: "InstantaneousDemand"},
+	} {
+		a.Add(r)
+	}
+	check := func(what string, expected ...Energy) {
+		costs := a.Costs()
+		if len(costs) != len(expected) {
+			t.Fatalf("%s: got %d periods instead of %d: %+v", what, len(costs), len(expected), costs)
+		}
+		for i, e := range expected {
+			if costs[i].Energy != e {
+				t.Errorf("%s: period %d used %v instead of %v", what, i, costs[i].Energy, e)
+			}
+		}
+	}
+	check("Late summation", 3.5, 1)
+	a.Add(Reading{Time: costStart.Add(time.Hour), Delivered: 106, Fragment: "CurrentSummation"})
+	check("Next summation", 4, 2)
+}
+
+func TestCostPeriods(t *testing.T) {
+	defer func(saved *time.Location, day int) { time.Local, BillingDay = saved, day }(time.Local, BillingDay)
+	time.Local = time.UTC
+	BillingDay = 15
+	tests := []struct {
+		period CostPeriod
+		t      time.Time
+		start  time.Time
+		end    time.Time
+	}{
+		{Daily, costStart, time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)},
+		{Billing, costStart, time.Date(2013, time.December, 15, 0, 0, 0, 0, time.UTC), time.Date(2014, time.January, 15, 0, 0, 0, 0, time.UTC)},
+		{Billing, costStart.AddDate(0, 0, 20), time.Date(2014, time.January, 15, 0, 0, 0, 0, time.UTC), time.Date(2014, time.February, 15, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		start := test.period.Start(test.t)
+		if end := test.period.End(start); !start.Equal(test.start) || !end.Equal(test.end) {
+			t.Errorf("%s period of %v: got %v to %v instead of %v to %v", test.period, test.t, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestGetCost(t *testing.T) {
+	defer func(saved *time.Location) { time.Local = saved }(time.Local)
+	time.Local = time.UTC
+	saved := Readings
+	defer func() { Readings = saved }()
+	Readings = NewMemoryStore(100)
+	for _, r := range costReadings() {
+		Readings.Append(r)
+	}
+	record := httptest.NewRecorder()
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/cost", RawQuery: "period=day&from=2014-01-01T00:00:00Z"},
+	}
+	CostHandler(record, req)
+	if record.Code != 200 {
+		t.Fatalf("Response was %d not 200", record.Code)
+	}
+	costs := []Cost{}
+	if err := json.Unmarshal(record.Body.Bytes(), &costs); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(costs) != 1 || costs[0].Cost.Rescale(2).String() != "0.40 CAD" || costs[0].Energy != 3 {
+		t.Errorf("Got %+v instead of 3kWh for 0.40 CAD", costs)
+	}
+
+	record = httptest.NewRecorder()
+	req.URL.RawQuery = "period=fortnight"
+	CostHandler(record, req)
+	if record.Code != 400 {
+		t.Errorf("Response was %d not 400", record.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxStatusHistory is the most status changes kept for each device
+const MaxStatusHistory = 100
+
+// A StatusChange is when an EAGLE's ZigBee radio went into a new state
+type StatusChange struct {
+	Time        time.Time `json:"time"`
+	Status      string    `json:"status"`
+	Description string    `json:"description,omitempty"`
+	StatusCode  string    `json:"status_code,omitempty"`
+}
+
+// A Device is what is known about an EAGLE from its DeviceInfo and
+// NetworkInfo fragments
+type Device struct {
+	MacId        string         `json:"mac_id"`
+	Meter        string         `json:"meter,omitempty"`
+	FWVersion    string         `json:"fw_version,omitempty"`
+	HWVersion    string         `json:"hw_version,omitempty"`
+	ImageType    string         `json:"image_type,omitempty"`
+	Manufacturer string         `json:"manufacturer,omitempty"`
+	ModelId      string         `json:"model_id,omitempty"`
+	DateCode     string         `json:"date_code,omitempty"`
+	Channel      string         `json:"channel,omitempty"`
+	ExtPanId     string         `json:"ext_pan_id,omitempty"`
+	ShortAddr    string         `json:"short_addr,omitempty"`
+	LinkStrength int            `json:"link_strength"`
+	Status       string         `json:"status,omitempty"`
+	StatusSince  time.Time      `json:"status_since"`
+	LastSeen     time.Time      `json:"last_seen"`
+	History      []StatusChange `json:"history"`
+}
+
+// A DeviceTracker keeps the latest state of each EAGLE and the changes in its
+// network status, in a JSON file if it has a path. The file is only written
+// when something other than the link strength changes.
+type DeviceTracker struct {
+	mu      sync.Mutex
+	path    string
+	devices map[string]*Device
+}
+
+// Devices is updated by the HTTP handlers
+var Devices = &DeviceTracker{}
+
+// OpenDeviceTracker loads the devices saved at path, if there are any
+func OpenDeviceTracker(path string) (*DeviceTracker, error) {
+	t := &DeviceTracker{path: path, devices: make(map[string]*Device)}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := []Device{}
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range saved {
+		t.devices[saved[i].MacId] = &saved[i]
+	}
+	return t, nil
+}
+
+// Callers must hold the lock
+func (t *DeviceTracker) device(mac string, now time.Time) *Device {
+	if t.devices == nil {
+		t.devices = make(map[string]*Device)
+	}
+	d, ok := t.devices[mac]
+	if !ok {
+		d = &Device{MacId: mac, History: []StatusChange{}}
+		t.devices[mac] = d
+	}
+	d.LastSeen = now
+	return d
+}
+
+func (t *DeviceTracker) UpdateInfo(info DeviceInfoFragment, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.device(info.DeviceMacId.String(), now)
+	old := *d
+	d.FWVersion = info.FWVersion
+	d.HWVersion = info.HWVersion
+	d.ImageType = info.ImageType
+	d.Manufacturer = info.Manufacturer
+	d.ModelId = info.ModelId
+	d.DateCode = info.DateCode
+	if d.FWVersion == old.FWVersion && d.HWVersion == old.HWVersion && d.ImageType == old.ImageType &&
+		d.Manufacturer == old.Manufacturer && d.ModelId == old.ModelId && d.DateCode == old.DateCode {
+		return nil
+	}
+	return t.save()
+}
+
+// UpdateNetwork records the network state of a device. Returns the change in
+// status, if there was one.
+func (t *DeviceTracker) UpdateNetwork(info NetworkInfoFragment, now time.Time) (*StatusChange, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.device(info.DeviceMacId.String(), now)
+	d.LinkStrength = int(info.LinkStrength)
+	// Optional fields are only replaced when they are given
+	for field, value := range map[*string]string{
+		&d.Meter:     info.CoordMacId.String(),
+		&d.Channel:   info.Channel,
+		&d.ExtPanId:  info.ExtPanId,
+		&d.ShortAddr: info.ShortAddr,
+	} {
+		if value != "" {
+			*field = value
+		}
+	}
+	if info.Status == "" || info.Status == d.Status {
+		return nil, nil
+	}
+	change := StatusChange{now, info.Status, info.Description, info.StatusCode}
+	d.Status, d.StatusSince = info.Status, now
+	d.History = append(d.History, change)
+	if len(d.History) > MaxStatusHistory {
+		d.History = d.History[len(d.History)-MaxStatusHistory:]
+	}
+	return &change, t.save()
+}
+
+// List the devices ordered by MAC address
+func (t *DeviceTracker) List() []Device {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.list()
+}
+
+// Callers must hold the lock
+func (t *DeviceTracker) list() []Device {
+	list := make([]Device, 0, len(t.devices))
+	for _, d := range t.devices {
+		device := *d
+		device.History = append([]StatusChange{}, d.History...)
+		list = append(list, device)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MacId < list[j].MacId })
+	return list
+}
+
+// Callers must hold the lock
+func (t *DeviceTracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	return writeJSONFile(t.path, t.list())
+}
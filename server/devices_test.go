@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const deviceInfo = `<rainforest macId="0xf0ad4e00ce69">
+  <DeviceInfo>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <InstallCode>0x0123456789abcdef</InstallCode>
+    <FWVersion>1.4.47 (6798)</FWVersion>
+    <HWVersion>1.2.3</HWVersion>
+    <ImageType>0x1301</ImageType>
+    <Manufacturer>Rainforest Automation</Manufacturer>
+    <ModelId>RFA-Z109</ModelId>
+    <DateCode>2013103023220630</DateCode>
+  </DeviceInfo>
+</rainforest>`
+
+func networkInfo(status, strength string) string {
+	return `<rainforest macId="0xf0ad4e00ce69">
+  <NetworkInfo>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <CoordMacId>0x00178d0000000004</CoordMacId>
+    <Status>` + status + `</Status>
+    <Channel>20</Channel>
+    <LinkStrength>` + strength + `</LinkStrength>
+  </NetworkInfo>
+</rainforest>`
+}
+
+func TestGetDevices(t *testing.T) {
+	dir, err := os.MkdirTemp("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+	saved := Devices
+	defer func() { Devices = saved }()
+	if Devices, err = OpenDeviceTracker(path); err != nil {
+		t.Fatal(err)
+	}
+	postFragment(t, deviceInfo)
+	postFragment(t, networkInfo("Joining", "0x1e"))
+	postFragment(t, networkInfo("Connected", "0x50"))
+	postFragment(t, networkInfo("Connected", "0x28"))
+
+	record := httptest.NewRecorder()
+	DevicesHandler(record, &http.Request{Method: "GET", URL: &url.URL{Path: "/devices"}})
+	devices := []Device{}
+	if err := json.Unmarshal(record.Body.Bytes(), &devices); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("Got %s instead of one device", record.Body)
+	}
+	d := devices[0]
+	if d.MacId != "00:15:8d:00:00:00:00:04" || d.Meter != "00:17:8d:00:00:00:00:04" || d.FWVersion != "1.4.47 (6798)" || d.Channel != "20" {
+		t.Errorf("Got %+v", d)
+	}
+	if d.LinkStrength != 40 || d.Status != "Connected" {
+		t.Errorf("Got link strength %d and status %s", d.LinkStrength, d.Status)
+	}
+	if len(d.History) != 2 || d.History[0].Status != "Joining" || d.History[1].Status != "Connected" || !d.StatusSince.Equal(d.History[1].Time) {
+		t.Errorf("Got history %+v", d.History)
+	}
+
+	reopened, err := OpenDeviceTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 1 || len(list[0].History) != 2 || list[0].ModelId != "RFA-Z109" {
+		t.Errorf("Got %+v after reopening", list)
+	}
+}
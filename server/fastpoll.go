@@ -0,0 +1,295 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Commander sends commands to the local API of one EAGLE. Package client
+// provides one.
+type Commander interface {
+	SetFastPoll(f SetFastPoll) error
+	FastPollStatus() (FastPollStatusFragment, error)
+}
+
+// The most the EAGLE will fast poll for in one go
+const MaxFastPollDuration = 15 * time.Minute
+
+var (
+	// FastPollRearmMargin is how long before a fast poll ends it is renewed
+	FastPollRearmMargin = 30 * time.Second
+	// FastPollRetryDelay is how long to wait after a failed attempt to renew
+	FastPollRetryDelay = time.Minute
+)
+
+var ErrNoCommander = errors.New("no local API configured for gateway")
+
+// A FastPollRequest asks for the meter to be polled every Frequency for
+// Duration at a time, renewing it until Until
+type FastPollRequest struct {
+	Meter     MacAddrHex
+	Frequency time.Duration
+	Duration  time.Duration
+	// Until is when to stop renewing; zero polls for Duration just once
+	Until time.Time
+}
+
+func (r FastPollRequest) validate() error {
+	if r.Frequency < time.Second || r.Frequency > 255*time.Second {
+		return fmt.Errorf("frequency %v isn't from 1s to 255s", r.Frequency)
+	}
+	if r.Duration < time.Minute || r.Duration > MaxFastPollDuration {
+		return fmt.Errorf("duration %v isn't from 1m to 15m", r.Duration)
+	}
+	return nil
+}
+
+// ParseFastPollRequest reads the gateway and request from the URL parameters
+// gateway, meter, frequency (default 1s), duration (default 15m) and either
+// for, how long to keep renewing it, or until, when to stop
+func ParseFastPollRequest(values url.Values, now time.Time) (string, FastPollRequest, error) {
+	r := FastPollRequest{Frequency: time.Second, Duration: MaxFastPollDuration}
+	gateway, err := ParseMacAddr(values.Get("gateway"))
+	if err != nil || gateway == "" {
+		return "", r, fmt.Errorf("gateway: %q isn't a MAC address", values.Get("gateway"))
+	}
+	if v := values.Get("meter"); v != "" {
+		meter, err := ParseMacAddr(v)
+		if err != nil {
+			return "", r, fmt.Errorf("meter: %v", err)
+		}
+		hw, _ := net.ParseMAC(meter)
+		r.Meter = MacAddrHex(hw)
+	}
+	if v := values.Get("frequency"); v != "" {
+		if r.Frequency, err = time.ParseDuration(v); err != nil {
+			return "", r, fmt.Errorf("frequency: %v", err)
+		}
+	}
+	if v := values.Get("duration"); v != "" {
+		if r.Duration, err = time.ParseDuration(v); err != nil {
+			return "", r, fmt.Errorf("duration: %v", err)
+		}
+	}
+	if v := values.Get("for"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return "", r, fmt.Errorf("for: %v", err)
+		}
+		r.Until = now.Add(d)
+	}
+	if v := values.Get("until"); v != "" {
+		if r.Until, err = parseQueryTime(v); err != nil {
+			return "", r, fmt.Errorf("until: %v", err)
+		}
+	}
+	return gateway, r, r.validate()
+}
+
+// FastPollState is what is known about fast polling on one EAGLE, both from
+// the FastPollStatus it last reported and from the request being kept up
+type FastPollState struct {
+	Gateway   string     `json:"gateway"`
+	Meter     string     `json:"meter,omitempty"`
+	Frequency int        `json:"frequency"` // seconds
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	Active    bool       `json:"active"`
+	Updated   time.Time  `json:"updated"`
+	// Until is when renewing stops, and NextArm when it will next be renewed
+	Until   *time.Time `json:"until,omitempty"`
+	NextArm *time.Time `json:"next_arm,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type fastPollSchedule struct {
+	FastPollRequest
+	generation int
+	timer      *time.Timer
+	next       time.Time
+}
+
+// A FastPoller sends fast poll requests to EAGLEs and keeps track of their
+// fast poll status
+type FastPoller struct {
+	mu         sync.Mutex
+	commanders map[string]Commander
+	states     map[string]*FastPollState
+	schedules  map[string]*fastPollSchedule
+	generation int
+}
+
+// FastPolls is updated by the HTTP handlers
+var FastPolls = &FastPoller{}
+
+// AddGateway lets fast polling be requested from an EAGLE, keyed by the MacId
+// of its uploads
+func (p *FastPoller) AddGateway(gateway string, c Commander) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.commanders == nil {
+		p.commanders = make(map[string]Commander)
+	}
+	p.commanders[gateway] = c
+}
+
+// Callers must hold the lock
+func (p *FastPoller) state(gateway string) *FastPollState {
+	if p.states == nil {
+		p.states = make(map[string]*FastPollState)
+	}
+	s, ok := p.states[gateway]
+	if !ok {
+		s = &FastPollState{Gateway: gateway}
+		p.states[gateway] = s
+	}
+	return s
+}
+
+// Update records a FastPollStatus from an EAGLE
+func (p *FastPoller) Update(gateway string, status FastPollStatusFragment, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.state(gateway)
+	if len(status.MeterMacId) > 0 {
+		s.Meter = status.MeterMacId.String()
+	}
+	s.Frequency = int(status.Frequency)
+	end := status.EndTime.Time()
+	s.EndTime = &end
+	s.Updated = now
+}
+
+// Request fast polling from an EAGLE, replacing any earlier request. It is
+// sent straight away and then renewed shortly before it ends until Until.
+func (p *FastPoller) Request(gateway string, r FastPollRequest) (FastPollState, error) {
+	if err := r.validate(); err != nil {
+		return FastPollState{}, err
+	}
+	p.mu.Lock()
+	if _, ok := p.commanders[gateway]; !ok {
+		p.mu.Unlock()
+		return FastPollState{}, ErrNoCommander
+	}
+	p.stop(gateway)
+	if p.schedules == nil {
+		p.schedules = make(map[string]*fastPollSchedule)
+	}
+	p.generation++
+	generation := p.generation
+	p.schedules[gateway] = &fastPollSchedule{FastPollRequest: r, generation: generation}
+	p.mu.Unlock()
+	err := p.arm(gateway, generation)
+	return p.Get(gateway), err
+}
+
+// Cancel stops renewing fast polling on an EAGLE. The EAGLE carries on until
+// the current fast poll ends.
+func (p *FastPoller) Cancel(gateway string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop(gateway)
+}
+
+// Callers must hold the lock
+func (p *FastPoller) stop(gateway string) {
+	if schedule, ok := p.schedules[gateway]; ok {
+		if schedule.timer != nil {
+			schedule.timer.Stop()
+		}
+		delete(p.schedules, gateway)
+	}
+}
+
+// Send the request for a schedule, if it hasn't been replaced, and set a
+// timer to renew it
+func (p *FastPoller) arm(gateway string, generation int) error {
+	p.mu.Lock()
+	schedule, ok := p.schedules[gateway]
+	c := p.commanders[gateway]
+	p.mu.Unlock()
+	if !ok || schedule.generation != generation {
+		return nil
+	}
+	r := schedule.FastPollRequest
+	err := c.SetFastPoll(SetFastPoll{MeterMacId: r.Meter, Frequency: r.Frequency, Duration: r.Duration})
+	now := time.Now()
+	var status FastPollStatusFragment
+	if err == nil {
+		if status, err = c.FastPollStatus(); err == nil {
+			p.Update(gateway, status, now)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if schedule, ok = p.schedules[gateway]; !ok || schedule.generation != generation {
+		return err
+	}
+	s := p.state(gateway)
+	s.Error = ""
+	next := now.Add(r.Duration - FastPollRearmMargin)
+	if err != nil {
+		log.Printf("Fast poll on %s: %v", gateway, err)
+		s.Error = err.Error()
+		next = now.Add(FastPollRetryDelay)
+	}
+	if r.Until.IsZero() || !next.Before(r.Until) {
+		delete(p.schedules, gateway)
+		return err
+	}
+	schedule.next = next
+	schedule.timer = time.AfterFunc(next.Sub(now), func() { p.arm(gateway, generation) })
+	return err
+}
+
+// Get the fast poll state of one EAGLE
+func (p *FastPoller) Get(gateway string) FastPollState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.get(gateway, time.Now())
+}
+
+// Callers must hold the lock
+func (p *FastPoller) get(gateway string, now time.Time) FastPollState {
+	s := FastPollState{Gateway: gateway}
+	if state, ok := p.states[gateway]; ok {
+		s = *state
+	}
+	s.Active = s.EndTime != nil && s.EndTime.After(now)
+	if schedule, ok := p.schedules[gateway]; ok {
+		until := schedule.Until
+		s.Until = &until
+		if !schedule.next.IsZero() {
+			next := schedule.next
+			s.NextArm = &next
+		}
+	}
+	return s
+}
+
+// List the fast poll state of every EAGLE that has reported it or can be
+// sent requests, ordered by gateway
+func (p *FastPoller) List() []FastPollState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gateways := map[string]bool{}
+	for gateway := range p.states {
+		gateways[gateway] = true
+	}
+	for gateway := range p.commanders {
+		gateways[gateway] = true
+	}
+	list := make([]FastPollState, 0, len(gateways))
+	now := time.Now()
+	for gateway := range gateways {
+		list = append(list, p.get(gateway, now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Gateway < list[j].Gateway })
+	return list
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Commander that pretends to be an EAGLE
+type fakeCommander struct {
+	mu       sync.Mutex
+	requests []SetFastPoll
+	fail     bool
+}
+
+func (c *fakeCommander) SetFastPoll(f SetFastPoll) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail {
+		return errors.New("no route to host")
+	}
+	c.requests = append(c.requests, f)
+	return nil
+}
+
+func (c *fakeCommander) FastPollStatus() (FastPollStatusFragment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.requests[len(c.requests)-1]
+	return FastPollStatusFragment{
+		MeterMacId: f.MeterMacId,
+		Frequency:  HexInt(f.Frequency / time.Second),
+		EndTime:    NewEagleTime(time.Now().Add(f.Duration)),
+	}, nil
+}
+
+func (c *fakeCommander) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.requests)
+}
+
+func TestFastPollRearm(t *testing.T) {
+	savedMargin := FastPollRearmMargin
+	defer func() { FastPollRearmMargin = savedMargin }()
+	FastPollRearmMargin = time.Minute - 10*time.Millisecond
+	p := &FastPoller{}
+	c := &fakeCommander{}
+	p.AddGateway("f0:ad:4e:00:ce:69", c)
+
+	if _, err := p.Request("f0:ad:4e:00:ce:70", FastPollRequest{Frequency: time.Second, Duration: time.Minute}); err != ErrNoCommander {
+		t.Errorf("Expected ErrNoCommander, got %v", err)
+	}
+	if _, err := p.Request("f0:ad:4e:00:ce:69", FastPollRequest{Frequency: time.Second, Duration: time.Hour}); err == nil {
+		t.Errorf("Expected a duration over 15m to be refused")
+	}
+	meter := MacAddrHex{0x00, 0x17, 0x8d, 0x00, 0x00, 0x00, 0x00, 0x04}
+	state, err := p.Request("f0:ad:4e:00:ce:69", FastPollRequest{
+		Meter:     meter,
+		Frequency: 2 * time.Second,
+		Duration:  time.Minute,
+		Until:     time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Active || state.Frequency != 2 || state.Meter != "00:17:8d:00:00:00:00:04" || state.NextArm == nil {
+		t.Errorf("Got state %+v", state)
+	}
+	for deadline := time.Now().Add(time.Second); c.count() < 3 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if c.count() < 3 {
+		t.Fatalf("Expected fast polling to be renewed, got %d requests", c.count())
+	}
+	p.Cancel("f0:ad:4e:00:ce:69")
+	n := c.count()
+	time.Sleep(50 * time.Millisecond)
+	if c.count() != n {
+		t.Errorf("Renewed %d times after being cancelled", c.count()-n)
+	}
+	if state := p.Get("f0:ad:4e:00:ce:69"); state.Until != nil || !state.Active {
+		t.Errorf("Got state %+v after cancelling", state)
+	}
+
+	c.fail = true
+	if state, err := p.Request("f0:ad:4e:00:ce:69", FastPollRequest{Frequency: time.Second, Duration: time.Minute}); err == nil || state.Error == "" {
+		t.Errorf("Expected the failure to be reported, got %+v", state)
+	}
+}
+
+func TestGetFastPoll(t *testing.T) {
+	savedPolls := FastPolls
+	defer func() { FastPolls = savedPolls }()
+	FastPolls = &FastPoller{}
+	FastPolls.AddGateway("f0:ad:4e:00:ce:70", &fakeCommander{})
+	postFragment(t, `<rainforest macId="0xf0ad4e00ce69">
+  <FastPollStatus>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <MeterMacId>0x00178d0000000004</MeterMacId>
+    <Frequency>0x01</Frequency>
+    <EndTime>0x185adc1d</EndTime>
+  </FastPollStatus>
+</rainforest>`)
+
+	record := httptest.NewRecorder()
+	FastPollHandler(record, &http.Request{Method: "POST", URL: &url.URL{Path: "/fastpoll", RawQuery: "gateway=0xf0ad4e00ce70&frequency=5s&duration=10m"}})
+	if record.Code != 200 {
+		t.Errorf("Got %d: %s", record.Code, record.Body)
+	}
+
+	record = httptest.NewRecorder()
+	FastPollHandler(record, &http.Request{Method: "GET", URL: &url.URL{Path: "/fastpoll"}})
+	states := []FastPollState{}
+	if err := json.Unmarshal(record.Body.Bytes(), &states); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("Got %s", record.Body)
+	}
+	if s := states[0]; s.Gateway != "f0:ad:4e:00:ce:69" || s.Active || s.Frequency != 1 || !s.EndTime.Equal(time.Date(2012, time.December, 12, 6, 9, 33, 0, time.UTC)) {
+		t.Errorf("Got uploaded state %+v", s)
+	}
+	if s := states[1]; !s.Active || s.Frequency != 5 {
+		t.Errorf("Got requested state %+v", s)
+	}
+
+	for _, query := range []string{"frequency=1s", "gateway=f0ad4e00ce70&frequency=0s", "gateway=f0ad4e00ce70&for=forever"} {
+		record = httptest.NewRecorder()
+		FastPollHandler(record, &http.Request{Method: "POST", URL: &url.URL{Path: "/fastpoll", RawQuery: query}})
+		if record.Code != 400 {
+			t.Errorf("%s got %d", query, record.Code)
+		}
+	}
+}
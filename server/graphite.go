@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+func init() {
+	RegisterSink("graphite", NewGraphiteSink)
+	RegisterSink("hostedgraphite", NewHostedGraphiteSink)
+}
+
+const (
+	hostedGraphiteAddr = "carbon.hostedgraphite.com:2003"
+	graphiteTimeout    = 10 * time.Second
+)
+
+// GraphiteSink sends metrics to Carbon using either the plaintext or the
+// pickle protocol. Each metric's path comes from Template, in which {name}
+// is replaced by the metric name and {tag} by the value of that tag, e.g.
+// "home.{meter}.{name}".
+type GraphiteSink struct {
+	Addr     string
+	Network  string // tcp or udp
+	Pickle   bool
+	Template string
+}
+
+// NewGraphiteSink reads the host, protocol (tcp or udp), format (plaintext or
+// pickle) and path settings. The host defaults to localhost on the standard
+// port for the format.
+func NewGraphiteSink(config SinkConfig) (Sink, error) {
+	sink := &GraphiteSink{
+		Addr:     config["host"],
+		Network:  config["protocol"],
+		Template: config["path"],
+	}
+	switch config["format"] {
+	case "", "plaintext":
+	case "pickle":
+		sink.Pickle = true
+	default:
+		return nil, fmt.Errorf("unknown format %q", config["format"])
+	}
+	switch sink.Network {
+	case "":
+		sink.Network = "tcp"
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", sink.Network)
+	}
+	if sink.Addr == "" {
+		sink.Addr = "localhost"
+	}
+	if _, _, err := net.SplitHostPort(sink.Addr); err != nil {
+		port := "2003"
+		if sink.Pickle {
+			port = "2004"
+		}
+		sink.Addr = net.JoinHostPort(sink.Addr, port)
+	}
+	if sink.Template == "" {
+		sink.Template = "eagle.{name}"
+	}
+	return sink, nil
+}
+
+// NewHostedGraphiteSink sends to hostedgraphite.com over UDP, using the API
+// key as the metric prefix
+func NewHostedGraphiteSink(config SinkConfig) (Sink, error) {
+	if config["apikey"] == "" {
+		return nil, errors.New("apikey is required")
+	}
+	return &GraphiteSink{
+		Addr:     hostedGraphiteAddr,
+		Network:  "udp",
+		Template: config["apikey"] + ".{name}",
+	}, nil
+}
+
+// Characters that would break up or confuse a Graphite path
+var unsafePath = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// Path fills in the template for a metric
+func (s *GraphiteSink) Path(m Metric) string {
+	return fillTemplate(s.Template, m, func(value string) string {
+		return unsafePath.ReplaceAllString(value, "_")
+	})
+}
+
+func (s *GraphiteSink) Send(metrics []Metric) error {
+	var payload []byte
+	if s.Pickle {
+		payload = s.pickle(metrics)
+	} else {
+		payload = s.plaintext(metrics)
+	}
+	conn, err := net.DialTimeout(s.Network, s.Addr, graphiteTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(graphiteTimeout))
+	_, err = conn.Write(payload)
+	return err
+}
+
+func graphiteTime(m Metric) time.Time {
+	if m.Time.IsZero() {
+		return time.Now()
+	}
+	return m.Time
+}
+
+func (s *GraphiteSink) plaintext(metrics []Metric) []byte {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "%s %s %d\n", s.Path(m), strconv.FormatFloat(m.Value, 'f', -1, 64), graphiteTime(m).Unix())
+	}
+	return buf.Bytes()
+}
+
+// Pickle opcodes, see Lib/pickletools.py
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// Encode the metrics as a length prefixed protocol 2 pickle of
+// [(path, (timestamp, value)), ...] for Carbon's pickle receiver
+func (s *GraphiteSink) pickle(metrics []Metric) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0, pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, m := range metrics {
+		path := s.Path(m)
+		buf.WriteByte(pickleBinUnicode)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(path)))
+		buf.WriteString(path)
+		buf.WriteByte(pickleBinInt)
+		binary.Write(&buf, binary.LittleEndian, int32(graphiteTime(m).Unix()))
+		buf.WriteByte(pickleBinFloat)
+		binary.Write(&buf, binary.BigEndian, math.Float64bits(m.Value))
+		buf.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+	buf.Write([]byte{pickleAppends, pickleStop})
+	payload := buf.Bytes()
+	binary.BigEndian.PutUint32(payload, uint32(len(payload)-4))
+	return payload
+}
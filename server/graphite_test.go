@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+var graphiteMetrics = []Metric{
+	{
+		Name:  "demand",
+		Value: 5.944,
+		Time:  time.Date(2012, time.December, 12, 6, 9, 33, 0, time.UTC),
+		Tags:  map[string]string{"meter": "00:17:8d:00:00:00:00:04", "rate": "Block 1"},
+	},
+	{
+		Name:  "price",
+		Value: 0.0797,
+		Time:  time.Date(2014, time.August, 25, 7, 5, 52, 0, time.UTC),
+		Tags:  map[string]string{"meter": "00:17:8d:00:00:00:00:04"},
+	},
+}
+
+func TestGraphitePath(t *testing.T) {
+	sink, _ := NewGraphiteSink(SinkConfig{"path": "home.{meter}.{name}.{rate}"})
+	tests := []struct {
+		metric   Metric
+		expected string
+	}{
+		{graphiteMetrics[0], "home.00_17_8d_00_00_00_00_04.demand.Block_1"},
+		{graphiteMetrics[1], "home.00_17_8d_00_00_00_00_04.price.unknown"},
+	}
+	for _, test := range tests {
+		if got := sink.(*GraphiteSink).Path(test.metric); got != test.expected {
+			t.Errorf("Got %s instead of %s", got, test.expected)
+		}
+	}
+}
+
+// Accept one TCP connection and return everything written to it
+func graphiteStandIn(t *testing.T) (string, chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf, _ := ioutil.ReadAll(conn)
+		received <- buf
+	}()
+	return l.Addr().String(), received
+}
+
+func TestGraphitePlaintextTCP(t *testing.T) {
+	addr, received := graphiteStandIn(t)
+	sink, _ := NewGraphiteSink(SinkConfig{"host": addr, "path": "home.{name}"})
+	if err := sink.Send(graphiteMetrics); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expected := "home.demand 5.944 1355292573\nhome.price 0.0797 1408950352\n"
+	if got := string(<-received); got != expected {
+		t.Errorf("Got:\n%s\ninstead of:\n%s", got, expected)
+	}
+}
+
+func TestGraphitePickle(t *testing.T) {
+	addr, received := graphiteStandIn(t)
+	sink, _ := NewGraphiteSink(SinkConfig{"host": addr, "format": "pickle", "path": "home.{name}"})
+	if err := sink.Send(graphiteMetrics); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	// pickle.dumps([("home.demand", (1355292573, 5.944)), ("home.price", (1408950352, 0.0797))], 2)
+	expected, _ := hex.DecodeString("0000004580025d28580b000000686f6d652e64656d616e644a9d1fc850474017c6a7ef9db22d8686580a000000686f6d652e70726963654a50e0fa53473fb467381d7dbf488686652e")
+	if got := <-received; !bytes.Equal(got, expected) {
+		t.Errorf("Got:\n%x\ninstead of:\n%x", got, expected)
+	}
+}
+
+func TestGraphiteUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	sink := &GraphiteSink{Addr: conn.LocalAddr().String(), Network: "udp", Template: "apikey.{name}"}
+	if err := sink.Send(graphiteMetrics[:1]); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := string(buf[:n]); got != "apikey.demand 5.944 1355292573\n" {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestGraphiteConfigErrors(t *testing.T) {
+	for _, config := range []SinkConfig{{"protocol": "sctp"}, {"format": "json"}} {
+		if _, err := NewGraphiteSink(config); err == nil {
+			t.Errorf("Expected an error from %v", config)
+		}
+	}
+	sink, _ := NewGraphiteSink(SinkConfig{"host": "carbon.local", "format": "pickle"})
+	if addr := sink.(*GraphiteSink).Addr; addr != "carbon.local:2004" {
+		t.Errorf("Got address %s", addr)
+	}
+}
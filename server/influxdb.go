@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterSink("influxdb", NewInfluxDBSink)
+	RegisterSink("influxdb08", NewInfluxDB08Sink)
+}
+
+// InfluxDBSink writes metrics in line protocol to the /write endpoint of
+// InfluxDB 1.x or, when a bucket is configured, the /api/v2/write endpoint of
+// InfluxDB 2.x. Each metric becomes a point in the measurement of the same
+// name with a single value field, its tags and the meter's timestamp.
+type InfluxDBSink struct {
+	// WriteURL is the complete write endpoint including its parameters
+	WriteURL string
+	// Token is sent as the Authorization for 2.x
+	Token    string
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// NewInfluxDBSink builds the write endpoint from the url setting and either
+// db and optional rp, username and password for 1.x or org, bucket and token
+// for 2.x.
+func NewInfluxDBSink(config SinkConfig) (Sink, error) {
+	base, err := url.Parse(config["url"])
+	if err != nil || config["url"] == "" {
+		return nil, fmt.Errorf("invalid url %q", config["url"])
+	}
+	sink := &InfluxDBSink{Client: &http.Client{}}
+	params := url.Values{"precision": {"s"}}
+	if bucket := config["bucket"]; bucket != "" {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/write"
+		params.Set("org", config["org"])
+		params.Set("bucket", bucket)
+		sink.Token = config["token"]
+	} else if db := config["db"]; db != "" {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/write"
+		params.Set("db", db)
+		if rp := config["rp"]; rp != "" {
+			params.Set("rp", rp)
+		}
+		sink.Username = config["username"]
+		sink.Password = config["password"]
+	} else {
+		return nil, errors.New("db (1.x) or bucket (2.x) is required")
+	}
+	base.RawQuery = params.Encode()
+	sink.WriteURL = base.String()
+	return sink, nil
+}
+
+func (s *InfluxDBSink) Send(metrics []Metric) error {
+	var body bytes.Buffer
+	for _, m := range metrics {
+		writeLine(&body, m)
+	}
+	req, err := http.NewRequest("POST", s.WriteURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	} else if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s %s", s.WriteURL, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Append a metric to buf in line protocol with a timestamp in seconds
+func writeLine(buf *bytes.Buffer, m Metric) {
+	buf.WriteString(measurementEscaper.Replace(m.Name))
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	// InfluxDB prefers tags in sorted order
+	sort.Strings(keys)
+	for _, k := range keys {
+		if m.Tags[k] == "" {
+			continue
+		}
+		fmt.Fprintf(buf, ",%s=%s", tagEscaper.Replace(k), tagEscaper.Replace(m.Tags[k]))
+	}
+	buf.WriteString(" value=")
+	buf.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+	if !m.Time.IsZero() {
+		fmt.Fprintf(buf, " %d", m.Time.Unix())
+	}
+	buf.WriteByte('\n')
+}
+
+// InfluxDB08Sink posts metrics to the series API of InfluxDB 0.8
+type InfluxDB08Sink struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewInfluxDB08Sink(config SinkConfig) (Sink, error) {
+	if config["url"] == "" {
+		return nil, errors.New("url is required")
+	}
+	return &InfluxDB08Sink{config["url"], &http.Client{}}, nil
+}
+
+type influxDB08Series struct {
+	Name    string      `json:"name"`
+	Columns []string    `json:"columns"`
+	Points  [][]float64 `json:"points"`
+}
+
+func (s *InfluxDB08Sink) Send(metrics []Metric) error {
+	series := make([]influxDB08Series, len(metrics))
+	for i, m := range metrics {
+		series[i] = influxDB08Series{m.Name, []string{"value"}, [][]float64{{m.Value}}}
+	}
+	body, err := json.Marshal(series)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
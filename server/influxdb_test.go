@@ -0,0 +1,125 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxDB08Sink(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+	sink, _ := NewInfluxDB08Sink(SinkConfig{"url": ts.URL})
+	err := sink.Send([]Metric{{Name: "demand", Value: 5944, Time: time.Now()}})
+	if err != nil {
+		t.Errorf("error: %v", err)
+	}
+	expected := `[{"name":"demand","columns":["value"],"points":[[5944]]}]`
+	if body != expected {
+		t.Errorf("Got: '%s' instead of '%s'", body, expected)
+	}
+	ts.Close()
+	if err := sink.Send([]Metric{{Name: "demand"}}); err == nil {
+		t.Errorf("Expected an error when InfluxDB is down")
+	}
+}
+
+// Stand in for InfluxDB that remembers the last write
+type influxStandIn struct {
+	*httptest.Server
+	req  *http.Request
+	body string
+}
+
+func newInfluxStandIn() *influxStandIn {
+	s := &influxStandIn{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		s.req, s.body = req, string(b)
+		w.WriteHeader(204)
+	}))
+	return s
+}
+
+var influxMetrics = []Metric{
+	{
+		Name:  "demand",
+		Value: 5.944,
+		Time:  time.Date(2012, time.December, 12, 6, 9, 33, 0, time.UTC),
+		Tags:  map[string]string{"meter": "00:17:8d:00:00:00:00:04", "device": "00:15:8d:00:00:00:00:04"},
+	},
+	{
+		Name:  "price",
+		Value: 0.0797,
+		Time:  time.Date(2014, time.August, 21, 21, 39, 28, 0, time.UTC),
+		Tags:  map[string]string{"rate": "Block 1", "device": "d8:d5:b9:00:00:00:2a:ea", "meter": ""},
+	},
+}
+
+const influxLines = `demand,device=00:15:8d:00:00:00:00:04,meter=00:17:8d:00:00:00:00:04 value=5.944 1355292573
+price,device=d8:d5:b9:00:00:00:2a:ea,rate=Block\ 1 value=0.0797 1408657168
+`
+
+func TestInfluxDBSinkV1(t *testing.T) {
+	influx := newInfluxStandIn()
+	defer influx.Close()
+	sink, err := NewInfluxDBSink(SinkConfig{"url": influx.URL, "db": "eagle", "username": "root", "password": "secret"})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if err := sink.Send(influxMetrics); err != nil {
+		t.Errorf("error: %v", err)
+	}
+	if influx.req.URL.Path != "/write" || influx.req.URL.Query().Get("db") != "eagle" {
+		t.Errorf("Wrote to %s", influx.req.URL)
+	}
+	if user, pass, _ := influx.req.BasicAuth(); user != "root" || pass != "secret" {
+		t.Errorf("Got credentials %s:%s", user, pass)
+	}
+	if influx.body != influxLines {
+		t.Errorf("Got:\n%s\ninstead of:\n%s", influx.body, influxLines)
+	}
+}
+
+func TestInfluxDBSinkV2(t *testing.T) {
+	influx := newInfluxStandIn()
+	defer influx.Close()
+	sink, err := NewInfluxDBSink(SinkConfig{"url": influx.URL + "/", "org": "home", "bucket": "power", "token": "t0k3n"})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if err := sink.Send(influxMetrics); err != nil {
+		t.Errorf("error: %v", err)
+	}
+	query := influx.req.URL.Query()
+	if influx.req.URL.Path != "/api/v2/write" || query.Get("org") != "home" || query.Get("bucket") != "power" || query.Get("precision") != "s" {
+		t.Errorf("Wrote to %s", influx.req.URL)
+	}
+	if auth := influx.req.Header.Get("Authorization"); auth != "Token t0k3n" {
+		t.Errorf("Got Authorization: %s", auth)
+	}
+	if influx.body != influxLines {
+		t.Errorf("Got:\n%s\ninstead of:\n%s", influx.body, influxLines)
+	}
+}
+
+func TestInfluxDBSinkErrors(t *testing.T) {
+	if _, err := NewInfluxDBSink(SinkConfig{"url": "http://localhost:8086"}); err == nil {
+		t.Errorf("Expected an error without db or bucket")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error":"unauthorized"}`))
+	}))
+	defer ts.Close()
+	sink, _ := NewInfluxDBSink(SinkConfig{"url": ts.URL, "db": "eagle"})
+	if err := sink.Send(influxMetrics); err == nil {
+		t.Errorf("Expected an error from a 401")
+	}
+}
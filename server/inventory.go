@@ -0,0 +1,89 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// An InventoryMeter is a meter an EAGLE has reported on
+type InventoryMeter struct {
+	MacId     string    `json:"mac_id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// A Gateway is an EAGLE that has uploaded fragments, identified by the MacId
+// of its uploads
+type Gateway struct {
+	MacId     string           `json:"mac_id"`
+	Device    string           `json:"device,omitempty"`
+	FirstSeen time.Time        `json:"first_seen"`
+	LastSeen  time.Time        `json:"last_seen"`
+	Fragments map[string]int64 `json:"fragments"`
+	Meters    []InventoryMeter `json:"meters"`
+}
+
+// An Inventory keeps track of the gateways and meters that have been heard
+// from since startup
+type Inventory struct {
+	mu       sync.Mutex
+	gateways map[string]*Gateway
+}
+
+// Gateways is updated by the HTTP handlers
+var Gateways = &Inventory{}
+
+// Record an upload
+func (i *Inventory) Record(req Request, now time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.gateways == nil {
+		i.gateways = make(map[string]*Gateway)
+	}
+	mac := req.MacId.String()
+	g, ok := i.gateways[mac]
+	if !ok {
+		g = &Gateway{MacId: mac, FirstSeen: now, Fragments: make(map[string]int64), Meters: []InventoryMeter{}}
+		i.gateways[mac] = g
+	}
+	g.LastSeen = now
+	g.Fragments[req.Fragment.XMLName.Local]++
+	f := req.Fragment
+	if f.DeviceMacId != nil {
+		g.Device = f.DeviceMacId.String()
+	}
+	meter := f.MeterMacId
+	if meter == nil {
+		meter = f.CoordMacId
+	}
+	if meter == nil {
+		return
+	}
+	for j := range g.Meters {
+		if g.Meters[j].MacId == meter.String() {
+			g.Meters[j].LastSeen = now
+			return
+		}
+	}
+	g.Meters = append(g.Meters, InventoryMeter{meter.String(), now, now})
+	sort.Slice(g.Meters, func(a, b int) bool { return g.Meters[a].MacId < g.Meters[b].MacId })
+}
+
+// List the gateways ordered by MacId
+func (i *Inventory) List() []Gateway {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	list := make([]Gateway, 0, len(i.gateways))
+	for _, g := range i.gateways {
+		gateway := *g
+		gateway.Fragments = make(map[string]int64, len(g.Fragments))
+		for name, n := range g.Fragments {
+			gateway.Fragments[name] = n
+		}
+		gateway.Meters = append([]InventoryMeter{}, g.Meters...)
+		list = append(list, gateway)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].MacId < list[b].MacId })
+	return list
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priorities of utility messages, lowest first
+var messagePriorities = []string{"Low", "Medium", "High", "Critical"}
+
+// The position of a priority in messagePriorities, or -1 if it is unknown
+func priorityLevel(priority string) int {
+	for i, p := range messagePriorities {
+		if strings.EqualFold(p, priority) {
+			return i
+		}
+	}
+	return -1
+}
+
+// A UtilityMessage is a message from the utility as the EAGLE last reported
+// it
+type UtilityMessage struct {
+	Meter                string     `json:"meter"`
+	Device               string     `json:"device"`
+	Id                   int64      `json:"id"`
+	Text                 string     `json:"text"`
+	Priority             string     `json:"priority"`
+	Time                 time.Time  `json:"time"`
+	Expires              *time.Time `json:"expires,omitempty"`
+	ConfirmationRequired bool       `json:"confirmation_required"`
+	Confirmed            bool       `json:"confirmed"`
+	Queue                string     `json:"queue"`
+	// When the message was first received and when it last changed, such as
+	// by being confirmed. Its time and expiry are kept as first received.
+	Received time.Time `json:"received"`
+	Updated  time.Time `json:"updated"`
+}
+
+func NewUtilityMessage(m MessageFragment, now time.Time) UtilityMessage {
+	msg := UtilityMessage{
+		Meter:                m.MeterMacId.String(),
+		Device:               m.DeviceMacId.String(),
+		Id:                   int64(m.Id),
+		Text:                 m.String(),
+		Priority:             m.Priority,
+		Time:                 m.Time(),
+		ConfirmationRequired: bool(m.ConfirmationRequired),
+		Confirmed:            bool(m.Confirmed),
+		Queue:                m.Queue,
+		Received:             now,
+		Updated:              now,
+	}
+	if expires := m.Expires(); !expires.IsZero() {
+		msg.Expires = &expires
+	}
+	return msg
+}
+
+func (m UtilityMessage) key() string {
+	return fmt.Sprintf("%s/%d", m.Meter, m.Id)
+}
+
+// Whether the content or confirmation state differs. The EAGLE stamps each
+// upload of a message with the time it was sent, and messages starting "now"
+// expire relative to that, so neither time counts.
+func (m UtilityMessage) changed(o UtilityMessage) bool {
+	o.Time, o.Expires, o.Received, o.Updated = m.Time, m.Expires, m.Received, m.Updated
+	return m != o
+}
+
+// MessageFilter selects messages for GET /messages
+type MessageFilter struct {
+	// Priority is the lowest priority included; empty includes all of them
+	Priority string
+	// Confirmed is "Y" or "N" to only include messages that have or haven't
+	// been confirmed
+	Confirmed string
+}
+
+func (f MessageFilter) match(m UtilityMessage) bool {
+	if f.Priority != "" && priorityLevel(m.Priority) < priorityLevel(f.Priority) {
+		return false
+	}
+	switch strings.ToUpper(f.Confirmed) {
+	case "Y":
+		return m.Confirmed
+	case "N":
+		return !m.Confirmed
+	}
+	return true
+}
+
+// A MessageStore holds the latest version of each message, one per meter
+// and message Id, in a JSON file if it has a path
+type MessageStore struct {
+	mu       sync.Mutex
+	path     string
+	messages map[string]UtilityMessage
+}
+
+// Messages holds the messages received by the HTTP handlers
+var Messages = &MessageStore{}
+
+// OpenMessageStore loads the messages saved at path, if there are any
+func OpenMessageStore(path string) (*MessageStore, error) {
+	s := &MessageStore{path: path, messages: make(map[string]UtilityMessage)}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := []UtilityMessage{}
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, m := range saved {
+		s.messages[m.key()] = m
+	}
+	return s, nil
+}
+
+// Add a message, or update it if it has been seen before. Returns whether it
+// is new.
+func (s *MessageStore) Add(m UtilityMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messages == nil {
+		s.messages = make(map[string]UtilityMessage)
+	}
+	old, seen := s.messages[m.key()]
+	if seen {
+		if !old.changed(m) {
+			return false, nil
+		}
+		m.Time, m.Expires, m.Received = old.Time, old.Expires, old.Received
+	}
+	s.messages[m.key()] = m
+	return !seen, s.save()
+}
+
+// List the messages that match the filter, newest first
+func (s *MessageStore) List(f MessageFilter) []UtilityMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list(f)
+}
+
+// Callers must hold the lock
+func (s *MessageStore) list(f MessageFilter) []UtilityMessage {
+	list := []UtilityMessage{}
+	for _, m := range s.messages {
+		if f.match(m) {
+			list = append(list, m)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Time.Equal(list[j].Time) {
+			return list[i].Time.After(list[j].Time)
+		}
+		return list[i].key() < list[j].key()
+	})
+	return list
+}
+
+// Write out all the messages; callers must hold the lock
+func (s *MessageStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSONFile(s.path, s.list(MessageFilter{}))
+}
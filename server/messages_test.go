@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func messageCluster(id, priority, confirmed string) string {
+	return `<rainforest macId="0xf0ad4e00ce69">
+  <MessageCluster>
+    <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+    <MeterMacId>0x00078100007d67bb</MeterMacId>
+    <TimeStamp>0x1b8d9bf3</TimeStamp>
+    <Id>` + id + `</Id>
+    <Text>Peak pricing 4&amp;ndash;7pm &gt; use less</Text>
+    <Priority>` + priority + `</Priority>
+    <StartTime>0x1b878fa1</StartTime>
+    <Duration>0x003c</Duration>
+    <ConfirmationRequired>Y</ConfirmationRequired>
+    <Confirmed>` + confirmed + `</Confirmed>
+    <Queue>Active</Queue>
+  </MessageCluster>
+</rainforest>`
+}
+
+func TestMessageEmptyFlags(t *testing.T) {
+	body := strings.Replace(messageCluster("0x000001b1", "High", ""), "<ConfirmationRequired>Y</ConfirmationRequired>", "<ConfirmationRequired/>", 1)
+	doc := struct {
+		RainforestDocument
+		Message MessageFragment `xml:"MessageCluster"`
+	}{}
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if doc.Message.ConfirmationRequired || doc.Message.Confirmed {
+		t.Errorf("Got %+v instead of N for empty flags", doc.Message)
+	}
+}
+
+func TestMessageStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "messages.json")
+	store, err := OpenMessageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2014, time.August, 25, 12, 0, 0, 0, time.UTC)
+	msg := UtilityMessage{Meter: "00:07:81:00:00:7d:67:bb", Id: 433, Priority: "Medium", Received: first, Updated: first}
+	if added, err := store.Add(msg); !added || err != nil {
+		t.Errorf("First add gave %v, %v", added, err)
+	}
+	// Repeats are stamped with when they were sent
+	msg.Time, msg.Received, msg.Updated = first.Add(time.Minute), first.Add(time.Minute), first.Add(time.Minute)
+	if added, err := store.Add(msg); added || err != nil {
+		t.Errorf("Repeat gave %v, %v", added, err)
+	}
+	if stored := store.List(MessageFilter{}); len(stored) != 1 || !stored[0].Updated.Equal(first) {
+		t.Errorf("Repeat updated %+v", stored)
+	}
+	msg.Confirmed, msg.Updated = true, first.Add(2*time.Minute)
+	store.Add(msg)
+	if stored := store.List(MessageFilter{}); len(stored) != 1 || !stored[0].Updated.Equal(msg.Updated) {
+		t.Errorf("Confirming didn't update %+v", stored)
+	}
+	store.Add(UtilityMessage{Meter: "00:07:81:00:00:7d:67:bb", Id: 434, Priority: "Low"})
+
+	reopened, err := OpenMessageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := reopened.List(MessageFilter{})
+	if len(all) != 2 {
+		t.Fatalf("Got %+v instead of 2 messages", all)
+	}
+	confirmed := reopened.List(MessageFilter{Confirmed: "Y"})
+	if len(confirmed) != 1 || confirmed[0].Id != 433 || !confirmed[0].Received.Equal(first) || !confirmed[0].Time.IsZero() {
+		t.Errorf("Got %+v instead of message 433 first received at %v", confirmed, first)
+	}
+	if medium := reopened.List(MessageFilter{Priority: "medium"}); len(medium) != 1 {
+		t.Errorf("Got %+v instead of just the medium priority message", medium)
+	}
+}
+
+func TestGetMessages(t *testing.T) {
+	saved := Messages
+	defer func() { Messages = saved }()
+	Messages = &MessageStore{}
+	postFragment(t, messageCluster("0x000001b1", "High", "N"))
+	postFragment(t, messageCluster("0x000001b1", "High", "N"))
+	postFragment(t, messageCluster("0x000001b2", "Low", "N"))
+
+	record := httptest.NewRecorder()
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/messages", RawQuery: "priority=High&confirmed=N"},
+	}
+	MessagesHandler(record, req)
+	messages := []UtilityMessage{}
+	if err := json.Unmarshal(record.Body.Bytes(), &messages); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Got %s instead of one message", record.Body)
+	}
+	m := messages[0]
+	if m.Id != 0x1b1 || m.Text != "Peak pricing 4–7pm > use less" || !m.ConfirmationRequired || m.Confirmed {
+		t.Errorf("Got %+v", m)
+	}
+	if m.Expires == nil || !m.Expires.Equal(time.Date(2014, time.August, 20, 17, 56, 1, 0, time.UTC)) {
+		t.Errorf("Got expiry %v", m.Expires)
+	}
+
+	record = httptest.NewRecorder()
+	req.URL.RawQuery = "priority=urgent"
+	MessagesHandler(record, req)
+	if record.Code != 400 {
+		t.Errorf("Response was %d not 400", record.Code)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rmg/iso4217"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Money is an exact amount of a currency: Amount / 10^Scale units of the
+// currency with ISO 4217 numeric code Currency
+type Money struct {
+	Amount   int64
+	Scale    int
+	Currency int
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+// CurrencyCode is the ISO 4217 alphabetic code, e.g. "CAD"
+func (m Money) CurrencyCode() string {
+	name, _ := iso4217.ByCode(m.Currency)
+	return name
+}
+
+// Rescale gives the same amount with a different number of decimal places,
+// rounding half away from zero if there are fewer of them
+func (m Money) Rescale(scale int) Money {
+	switch {
+	case scale > m.Scale:
+		m.Amount *= pow10(scale - m.Scale)
+	case scale < m.Scale:
+		div := pow10(m.Scale - scale)
+		q, r := m.Amount/div, m.Amount%div
+		if 2*r >= div {
+			q++
+		} else if 2*r <= -div {
+			q--
+		}
+		m.Amount = q
+	}
+	m.Scale = scale
+	return m
+}
+
+// Add gives the sum of two amounts at the larger of their scales. A zero
+// Money takes on the currency of the other; otherwise it is up to the caller
+// to only add amounts of the same currency.
+func (m Money) Add(o Money) Money {
+	if o.Scale > m.Scale {
+		m = m.Rescale(o.Scale)
+	} else {
+		o = o.Rescale(m.Scale)
+	}
+	if m.Currency == 0 {
+		m.Currency = o.Currency
+	}
+	m.Amount += o.Amount
+	return m
+}
+
+func (m Money) Sub(o Money) Money {
+	o.Amount = -o.Amount
+	return m.Add(o)
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) Float() float64 {
+	return float64(m.Amount) / math.Pow10(m.Scale)
+}
+
+// Decimal formats the amount with at least as many decimal places as the
+// currency's minor unit, e.g. "0.0797" or "5.00"
+func (m Money) Decimal() string {
+	_, minor := iso4217.ByCode(m.Currency)
+	if minor > m.Scale {
+		m = m.Rescale(minor)
+	}
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if m.Scale <= 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	div := pow10(m.Scale)
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/div, m.Scale, amount%div)
+}
+
+func (m Money) String() string {
+	return strings.TrimSpace(m.Decimal() + " " + m.CurrencyCode())
+}
+
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	Per      string `json:"per,omitempty"`
+}
+
+// MarshalJSON gives the amount as a decimal string so it stays exact
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Decimal(), Currency: m.CurrencyCode()})
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	v := moneyJSON{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(v.Amount, v.Currency)
+	*m = parsed
+	return err
+}
+
+var (
+	currencyCodesOnce sync.Once
+	currencyCodes     map[string]int
+)
+
+// ParseMoney reads a decimal amount such as "-0.0797" in the currency with
+// the given alphabetic code
+func ParseMoney(amount, currency string) (Money, error) {
+	currencyCodesOnce.Do(func() {
+		currencyCodes = make(map[string]int)
+		for code := 0; code < 1000; code++ {
+			if name, _ := iso4217.ByCode(code); name != "" {
+				currencyCodes[name] = code
+			}
+		}
+	})
+	m := Money{}
+	if currency != "" {
+		code, ok := currencyCodes[currency]
+		if !ok {
+			return m, fmt.Errorf("unknown currency %q", currency)
+		}
+		m.Currency = code
+	}
+	if amount == "" {
+		return m, nil
+	}
+	digits := amount
+	if i := strings.Index(amount, "."); i >= 0 {
+		digits = amount[:i] + amount[i+1:]
+		m.Scale = len(amount) - i - 1
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return m, fmt.Errorf("invalid amount %q", amount)
+	}
+	m.Amount = n
+	return m, nil
+}
+
+// Price is the cost of one kWh
+type Price struct {
+	Money
+}
+
+func (p Price) String() string {
+	return p.Money.String() + "/kWh"
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: p.Decimal(), Currency: p.CurrencyCode(), Per: "kWh"})
+}
+
+// Cost is the price of an amount of energy. Energy is only kept to Precision
+// decimal places so the cost has that many more than the price.
+func (p Price) Cost(e Energy) Money {
+	scaled := int64(math.Round(float64(e) * math.Pow10(Precision)))
+	return Money{p.Amount * scaled, p.Scale + Precision, p.Currency}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const cad = 124
+
+func TestMoneyDecimal(t *testing.T) {
+	tests := []struct {
+		money    Money
+		expected string
+	}{
+		{Money{797, 4, cad}, "0.0797 CAD"},
+		{Money{5, 0, cad}, "5.00 CAD"},
+		{Money{-15, 1, cad}, "-1.50 CAD"},
+		{Money{1234, 3, 392}, "1.234 JPY"},
+		{Money{12, 0, 0}, "12"},
+	}
+	for _, test := range tests {
+		if got := test.money.String(); got != test.expected {
+			t.Errorf("%+v: got %q instead of %q", test.money, got, test.expected)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	m := Money{797, 4, cad}.Add(Money{5, 1, cad})
+	if m != (Money{5797, 4, cad}) {
+		t.Errorf("Got %+v instead of 0.5797", m)
+	}
+	if m = m.Sub(Money{5797, 4, cad}); !m.IsZero() {
+		t.Errorf("Got %+v instead of zero", m)
+	}
+	if m = (Money{}).Add(Money{1, 2, cad}); m.Currency != cad {
+		t.Errorf("Zero money should take the other currency, got %+v", m)
+	}
+	for amount, expected := range map[int64]int64{125: 13, 124: 12, -125: -13, -124: -12} {
+		if got := (Money{amount, 3, cad}).Rescale(2).Amount; got != expected {
+			t.Errorf("Rescale %d: got %d instead of %d", amount, got, expected)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	p := Price{Money{797, 4, cad}}
+	js, _ := json.Marshal(p)
+	expected := `{"amount":"0.0797","currency":"CAD","per":"kWh"}`
+	if string(js) != expected {
+		t.Errorf("Got %s instead of %s", js, expected)
+	}
+	out := Price{}
+	if err := json.Unmarshal(js, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != p {
+		t.Errorf("Got %+v instead of %+v", out, p)
+	}
+	if err := json.Unmarshal([]byte(`{"amount":"1","currency":"XYZ"}`), &out); err == nil {
+		t.Errorf("Expected an error for an unknown currency")
+	}
+}
+
+func TestPriceCost(t *testing.T) {
+	p := Price{Money{797, 4, cad}}
+	cost := p.Cost(Energy(12.5))
+	if s := cost.String(); s != "0.9962500 CAD" {
+		t.Errorf("Got %s instead of 0.9962500 CAD", s)
+	}
+	if s := cost.Rescale(2).String(); s != "1.00 CAD" {
+		t.Errorf("Got %s instead of 1.00 CAD", s)
+	}
+}
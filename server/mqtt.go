@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("mqtt", NewMQTTSink)
+}
+
+const mqttTimeout = 10 * time.Second
+
+// MQTTSink publishes each metric to a topic made from Template the same way
+// as GraphiteSink makes paths, e.g. "eagle/{gateway}/{meter}/{name}". Unless
+// DiscoveryPrefix is empty it also publishes Home Assistant MQTT discovery
+// config the first time it sees each metric from a meter, so the meters show
+// up as sensors usable by the energy dashboard.
+type MQTTSink struct {
+	Addr            string
+	ClientID        string
+	Username        string
+	Password        string
+	Template        string
+	Retain          bool
+	DiscoveryPrefix string
+
+	mu         sync.Mutex
+	conn       *mqttConn
+	discovered map[string]bool
+}
+
+// NewMQTTSink reads the host, username, password, client_id, topic, retain
+// (Y or N) and discovery_prefix settings. Setting discovery_prefix to "none"
+// turns off discovery.
+func NewMQTTSink(config SinkConfig) (Sink, error) {
+	sink := &MQTTSink{
+		Addr:            config["host"],
+		ClientID:        config["client_id"],
+		Username:        config["username"],
+		Password:        config["password"],
+		Template:        config["topic"],
+		Retain:          strings.HasPrefix(strings.ToUpper(config["retain"]), "Y"),
+		DiscoveryPrefix: config["discovery_prefix"],
+		discovered:      make(map[string]bool),
+	}
+	if sink.Addr == "" {
+		sink.Addr = "localhost"
+	}
+	if _, _, err := net.SplitHostPort(sink.Addr); err != nil {
+		sink.Addr = net.JoinHostPort(sink.Addr, "1883")
+	}
+	if sink.ClientID == "" {
+		sink.ClientID = "eagle"
+	}
+	if sink.Template == "" {
+		sink.Template = "eagle/{gateway}/{meter}/{name}"
+	}
+	switch sink.DiscoveryPrefix {
+	case "":
+		sink.DiscoveryPrefix = "homeassistant"
+	case "none":
+		sink.DiscoveryPrefix = ""
+	}
+	return sink, nil
+}
+
+// Keep MQTT wildcards and separators out of the topic levels
+var topicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+func (s *MQTTSink) Topic(m Metric) string {
+	return fillTemplate(s.Template, m, topicEscaper.Replace)
+}
+
+func (s *MQTTSink) Send(metrics []Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := dialMQTT(s.Addr, s.ClientID, s.Username, s.Password)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	err := s.publish(metrics)
+	if err != nil {
+		// Start again with a new connection next time
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// Callers must hold the lock
+func (s *MQTTSink) publish(metrics []Metric) error {
+	for _, m := range metrics {
+		topic := s.Topic(m)
+		if s.DiscoveryPrefix != "" && !s.discovered[topic] {
+			if config, ok := discoveryConfig(m, topic); ok {
+				payload, err := json.Marshal(config)
+				if err != nil {
+					return err
+				}
+				if err := s.conn.Publish(s.discoveryTopic(m), payload, true); err != nil {
+					return err
+				}
+			}
+			s.discovered[topic] = true
+		}
+		value := strconv.FormatFloat(m.Value, 'f', -1, 64)
+		if err := s.conn.Publish(topic, []byte(value), s.Retain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MQTTSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Identifier for a meter seen through a gateway that is safe to use in
+// topics and unique ids
+func discoveryNode(m Metric) string {
+	return "eagle_" + strings.Replace(m.Tags["gateway"], ":", "", -1) + "_" + strings.Replace(m.Tags["meter"], ":", "", -1)
+}
+
+func (s *MQTTSink) discoveryTopic(m Metric) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", s.DiscoveryPrefix, discoveryNode(m), m.Name)
+}
+
+// How each metric appears in Home Assistant. Monetary sensors can only have a
+// currency as their unit, so price per kWh has no device class.
+var discoverySensors = map[string]struct {
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+	diagnostic  bool
+}{
+	"demand":        {"Demand", "power", "measurement", "kW", false},
+	"delivered":     {"Energy delivered", "energy", "total_increasing", "kWh", false},
+	"received":      {"Energy received", "energy", "total_increasing", "kWh", false},
+	"price":         {"Price", "", "", "", false},
+	"cost_day":      {"Cost today", "monetary", "total", "", false},
+	"cost_billing":  {"Cost this billing period", "monetary", "total", "", false},
+	"link_strength": {"Link strength", "", "measurement", "%", true},
+	"connected":     {"Connected", "", "measurement", "", true},
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type discoveryPayload struct {
+	Name              string          `json:"name"`
+	UniqueId          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	UnitOfMeasurement string          `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string          `json:"entity_category,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+func discoveryConfig(m Metric, topic string) (discoveryPayload, bool) {
+	sensor, ok := discoverySensors[m.Name]
+	if !ok {
+		return discoveryPayload{}, false
+	}
+	node := discoveryNode(m)
+	config := discoveryPayload{
+		Name:              sensor.name,
+		UniqueId:          node + "_" + m.Name,
+		StateTopic:        topic,
+		DeviceClass:       sensor.deviceClass,
+		StateClass:        sensor.stateClass,
+		UnitOfMeasurement: sensor.unit,
+		Device: discoveryDevice{
+			Identifiers:  []string{node},
+			Name:         "EAGLE " + m.Tags["meter"],
+			Manufacturer: "Rainforest Automation",
+			Model:        "RFA-Z109",
+		},
+	}
+	if currency := m.Tags["currency"]; currency != "" {
+		switch {
+		case m.Name == "price":
+			config.UnitOfMeasurement = currency + "/kWh"
+		case sensor.deviceClass == "monetary":
+			config.UnitOfMeasurement = currency
+		}
+	}
+	if sensor.diagnostic {
+		config.EntityCategory = "diagnostic"
+	}
+	return config, true
+}
+
+// Just enough of an MQTT 3.1.1 client to publish at QoS 0
+type mqttConn struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xe0
+	mqttRetain     = 0x01
+)
+
+func dialMQTT(addr, clientID, username, password string) (*mqttConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, mqttTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn, bufio.NewReader(conn)}
+	var flags byte = 0x02 // clean session
+	body := appendMQTTString(nil, "MQTT")
+	payload := appendMQTTString(nil, clientID)
+	if username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, username)
+		if password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, password)
+		}
+	}
+	// Protocol level 4 and no keep alive
+	body = append(body, 4, flags, 0, 0)
+	body = append(body, payload...)
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	if err := c.write(mqttConnect, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	header, ack, err := c.read()
+	if err == nil && (header&0xf0 != mqttConnack || len(ack) != 2) {
+		err = fmt.Errorf("expected CONNACK, got packet type %#x", header>>4)
+	}
+	if err == nil && ack[1] != 0 {
+		err = fmt.Errorf("connection refused, return code %d", ack[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	// Remaining length, 7 bits at a time
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func (c *mqttConn) read() (byte, []byte, error) {
+	header, err := c.in.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := c.in.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(c.in, body)
+	return header, body, err
+}
+
+func (c *mqttConn) Publish(topic string, payload []byte, retain bool) error {
+	var header byte = mqttPublish
+	if retain {
+		header |= mqttRetain
+	}
+	c.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	return c.write(header, append(appendMQTTString(nil, topic), payload...))
+}
+
+func (c *mqttConn) Close() error {
+	c.write(mqttDisconnect, nil)
+	return c.conn.Close()
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+type mqttMessage struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// Stand in for an MQTT broker that accepts connections from the given user
+// and passes on everything published
+type mqttBroker struct {
+	listener net.Listener
+	username string
+	password string
+	messages chan mqttMessage
+}
+
+func newMQTTBroker(t *testing.T, username, password string) *mqttBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &mqttBroker{l, username, password, make(chan mqttMessage, 100)}
+	go b.serve()
+	return b
+}
+
+func (b *mqttBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *mqttBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	c := &mqttConn{conn, bufio.NewReader(conn)}
+	header, body, err := c.read()
+	if err != nil || header != mqttConnect {
+		return
+	}
+	// Skip the protocol name and level, then check the credentials
+	flags := body[7]
+	rest := body[10:]
+	readString := func() string {
+		n := int(rest[0])<<8 | int(rest[1])
+		s := string(rest[2 : 2+n])
+		rest = rest[2+n:]
+		return s
+	}
+	readString() // client id
+	var username, password string
+	if flags&0x80 != 0 {
+		username = readString()
+	}
+	if flags&0x40 != 0 {
+		password = readString()
+	}
+	if username != b.username || password != b.password {
+		c.write(mqttConnack, []byte{0, 5})
+		return
+	}
+	c.write(mqttConnack, []byte{0, 0})
+	for {
+		header, body, err := c.read()
+		if err != nil || header == mqttDisconnect {
+			return
+		}
+		if header&0xf0 == mqttPublish {
+			n := int(body[0])<<8 | int(body[1])
+			b.messages <- mqttMessage{string(body[2 : 2+n]), string(body[2+n:]), header&mqttRetain != 0}
+		}
+	}
+}
+
+func (b *mqttBroker) next(t *testing.T) mqttMessage {
+	select {
+	case m := <-b.messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a message")
+	}
+	return mqttMessage{}
+}
+
+var mqttMetrics = []Metric{
+	{Name: "demand", Value: 5.944, Tags: map[string]string{"gateway": "f0:ad:4e:00:ce:69", "meter": "00:17:8d:00:00:00:00:04"}},
+	{Name: "delivered", Value: 20060.767, Tags: map[string]string{"gateway": "f0:ad:4e:00:ce:69", "meter": "00:17:8d:00:00:00:00:04"}},
+}
+
+func TestMQTTSinkPublishes(t *testing.T) {
+	broker := newMQTTBroker(t, "eagle", "secret")
+	defer broker.listener.Close()
+	sink, _ := NewMQTTSink(SinkConfig{
+		"host":     broker.listener.Addr().String(),
+		"username": "eagle",
+		"password": "secret",
+		"topic":    "home/{meter}/{name}",
+		"retain":   "Y",
+	})
+	defer sink.(*MQTTSink).Close()
+	if err := sink.Send(mqttMetrics); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	config := broker.next(t)
+	if config.topic != "homeassistant/sensor/eagle_f0ad4e00ce69_00178d0000000004/demand/config" || !config.retain {
+		t.Errorf("Got discovery %+v", config)
+	}
+	payload := discoveryPayload{}
+	json.Unmarshal([]byte(config.payload), &payload)
+	if payload.DeviceClass != "power" || payload.StateTopic != "home/00:17:8d:00:00:00:00:04/demand" || payload.UnitOfMeasurement != "kW" {
+		t.Errorf("Got discovery payload %s", config.payload)
+	}
+	if m := broker.next(t); m != (mqttMessage{"home/00:17:8d:00:00:00:00:04/demand", "5.944", true}) {
+		t.Errorf("Got %+v", m)
+	}
+
+	json.Unmarshal([]byte(broker.next(t).payload), &payload)
+	if payload.DeviceClass != "energy" || payload.StateClass != "total_increasing" || payload.UnitOfMeasurement != "kWh" {
+		t.Errorf("Got discovery payload %+v", payload)
+	}
+	if m := broker.next(t); m.payload != "20060.767" {
+		t.Errorf("Got %+v", m)
+	}
+
+	// Discovery is only published once
+	sink.Send(mqttMetrics[:1])
+	if m := broker.next(t); m.topic != "home/00:17:8d:00:00:00:00:04/demand" {
+		t.Errorf("Got %+v", m)
+	}
+}
+
+func TestMQTTDiscoveryConfig(t *testing.T) {
+	sink, _ := NewMQTTSink(SinkConfig{})
+	price := Metric{Name: "price", Value: 0.0797, Tags: map[string]string{"gateway": "f0:ad:4e:00:ce:69", "meter": "00:17:8d:00:00:00:00:04", "currency": "USD"}}
+	if topic := sink.(*MQTTSink).Topic(price); topic != "eagle/f0:ad:4e:00:ce:69/00:17:8d:00:00:00:00:04/price" {
+		t.Errorf("Got default topic %s", topic)
+	}
+	config, _ := discoveryConfig(price, "")
+	if config.DeviceClass != "" || config.UnitOfMeasurement != "USD/kWh" {
+		t.Errorf("Got price config %+v", config)
+	}
+	cost := Metric{Name: "cost_day", Value: 1.2, Tags: price.Tags}
+	if config, _ := discoveryConfig(cost, ""); config.DeviceClass != "monetary" || config.UnitOfMeasurement != "USD" {
+		t.Errorf("Got cost config %+v", config)
+	}
+	// The same meter through another gateway is another device
+	other := Metric{Name: "price", Tags: map[string]string{"gateway": "f0:ad:4e:00:ce:70", "meter": price.Tags["meter"]}}
+	if discoveryNode(other) == discoveryNode(price) {
+		t.Errorf("Both gateways got node %s", discoveryNode(price))
+	}
+}
+
+func TestMQTTSinkRefused(t *testing.T) {
+	broker := newMQTTBroker(t, "eagle", "secret")
+	defer broker.listener.Close()
+	sink, _ := NewMQTTSink(SinkConfig{"host": broker.listener.Addr().String(), "username": "eagle"})
+	if err := sink.Send(mqttMetrics); err == nil {
+		t.Errorf("Expected the connection to be refused")
+	}
+}
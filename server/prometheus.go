@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An Exporter holds the current state of the meters in the Prometheus text
+// exposition format
+type Exporter struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	kind   string // gauge or counter
+	help   string
+	values map[string]float64 // keyed by rendered labels
+}
+
+// Prometheus is the exporter updated by the HTTP handlers
+var Prometheus = NewExporter()
+
+func NewExporter() *Exporter {
+	e := &Exporter{families: make(map[string]*family)}
+	e.Declare("eagle_demand_watts", "gauge", "Instantaneous demand in watts")
+	e.Declare("eagle_summation_delivered_kwh", "gauge", "Total energy delivered from the utility in kWh")
+	e.Declare("eagle_summation_received_kwh", "gauge", "Total energy received by the utility in kWh")
+	e.Declare("eagle_price", "gauge", "Current price per kWh")
+	e.Declare("eagle_price_tier", "gauge", "Current price tier")
+	e.Declare("eagle_block", "gauge", "Current price block")
+	e.Declare("eagle_block_consumption_kwh", "gauge", "Energy delivered so far in the block period in kWh")
+	e.Declare("eagle_block_remaining_kwh", "gauge", "Energy left before the next price block in kWh, 0 in the last block")
+	e.Declare("eagle_cost", "gauge", "Cost of energy so far in the current hour, day and billing period")
+	e.Declare("eagle_link_strength", "gauge", "Strength of the ZigBee link to the meter, 0-100")
+	e.Declare("eagle_connected", "gauge", "Whether each EAGLE is connected to its meter")
+	e.Declare("eagle_status_changes_total", "counter", "Changes in each EAGLE's network status by new status")
+	e.Declare("eagle_device_info", "gauge", "Model and versions of each EAGLE")
+	e.Declare("eagle_fast_poll_end_time_seconds", "gauge", "When fast polling of each meter ends, in seconds since the Unix epoch")
+	e.Declare("eagle_uploads_refused_total", "counter", "Uploads refused by gateway and whether they were rejected or quarantined")
+	e.Declare("eagle_fragments_total", "counter", "Fragments received from each EAGLE by type")
+	return e
+}
+
+// Declare adds a metric family so it is always exported, even when empty
+func (e *Exporter) Declare(name, kind, help string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.families[name] = &family{kind, help, make(map[string]float64)}
+}
+
+// Set a gauge. Labels are given as name, value pairs.
+func (e *Exporter) Set(name string, value float64, labels ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.family(name).values[renderLabels(labels)] = value
+}
+
+// Inc increments a counter. Labels are given as name, value pairs.
+func (e *Exporter) Inc(name string, labels ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.family(name).values[renderLabels(labels)]++
+}
+
+// Delete the series of a metric that have all of the given labels, such as
+// ones whose other labels have since changed. Labels are given as name, value
+// pairs.
+func (e *Exporter) Delete(name string, labels ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f := e.family(name)
+	for key := range f.values {
+		if hasLabels(key, labels) {
+			delete(f.values, key)
+		}
+	}
+}
+
+// Callers must hold the lock
+func (e *Exporter) family(name string) *family {
+	f, ok := e.families[name]
+	if !ok {
+		f = &family{"untyped", "", make(map[string]float64)}
+		e.families[name] = f
+	}
+	return f
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Whether rendered labels include all of the name, value pairs
+func hasLabels(rendered string, labels []string) bool {
+	for i := 0; i+1 < len(labels); i += 2 {
+		pair := renderLabels(labels[i : i+2])
+		pair = pair[1 : len(pair)-1]
+		if !strings.Contains(rendered, "{"+pair+",") && !strings.Contains(rendered, ","+pair+",") &&
+			!strings.Contains(rendered, ","+pair+"}") && rendered != "{"+pair+"}" {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Exporter) writeTo(buf *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.families))
+	for name := range e.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := e.families[name]
+		if f.help != "" {
+			fmt.Fprintf(buf, "# HELP %s %s\n", name, f.help)
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, f.kind)
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%s%s %s\n", name, k, strconv.FormatFloat(f.values[k], 'g', -1, 64))
+		}
+	}
+}
+
+// ServeHTTP writes the exporter's metrics along with the state of the sink
+// queues
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	e.writeTo(&buf)
+	writeSinkStats(&buf, Sinks.Stats())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func writeSinkStats(buf *bytes.Buffer, stats map[string]QueueStats) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf.WriteString("# HELP eagle_sink_queued Batches waiting in each sink's queue\n")
+	buf.WriteString("# TYPE eagle_sink_queued gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "eagle_sink_queued%s %d\n", renderLabels([]string{"sink", name}), stats[name].Queued)
+	}
+	buf.WriteString("# HELP eagle_sink_batches_total Batches handled by each sink by result\n")
+	buf.WriteString("# TYPE eagle_sink_batches_total counter\n")
+	for _, name := range names {
+		s := stats[name]
+		results := []struct {
+			result string
+			count  int64
+		}{
+			{"sent", s.Sent},
+			{"retried", s.Retried},
+			{"spilled", s.Spilled},
+			{"replayed", s.Replayed},
+			{"dropped", s.Dropped},
+		}
+		for _, r := range results {
+			fmt.Fprintf(buf, "eagle_sink_batches_total%s %d\n", renderLabels([]string{"sink", name, "result", r.result}), r.count)
+		}
+	}
+}
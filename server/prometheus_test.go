@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postFragment(t *testing.T, body string) {
+	record := httptest.NewRecorder()
+	req := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/metrics"},
+		Body:   ioutil.NopCloser(strings.NewReader(body)),
+	}
+	MetricsHandler(record, req)
+	if record.Code != 200 {
+		t.Errorf("Response got %d not 200", record.Code)
+	}
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	savedReadings, savedPrometheus := Readings, Prometheus
+	defer func() { Readings, Prometheus = savedReadings, savedPrometheus }()
+	Readings, Prometheus = NewMemoryStore(10), NewExporter()
+
+	postFragment(t, `<rainforest macId="0xf0ad4e00ce69">
+  <InstantaneousDemand>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <MeterMacId>0x00178d0000000004</MeterMacId>
+    <TimeStamp>0x185adc1d</TimeStamp>
+    <Demand>0x001738</Demand>
+    <Multiplier>0x00000001</Multiplier>
+    <Divisor>0x000003e8</Divisor>
+  </InstantaneousDemand>
+  </rainforest>`)
+	postFragment(t, `<rainforest macId="0xf0ad4e00ce69">
+  <PriceCluster>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <MeterMacId>0x00178d0000000004</MeterMacId>
+    <Price>0x0000031d</Price>
+    <Currency>0x007c</Currency>
+    <TrailingDigits>0x04</TrailingDigits>
+    <Tier>0x02</Tier>
+  </PriceCluster>
+  </rainforest>`)
+	postFragment(t, `<rainforest macId="0xf0ad4e00ce69">
+  <NetworkInfo>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <CoordMacId>0x00178d0000000004</CoordMacId>
+    <Status>Connected</Status>
+    <LinkStrength>0x5a</LinkStrength>
+  </NetworkInfo>
+  </rainforest>`)
+	postFragment(t, `<rainforest macId="0xf0ad4e00ce69">
+  <NetworkInfo>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <CoordMacId>0x00178d0000000004</CoordMacId>
+    <Status>Connected</Status>
+    <LinkStrength>0x64</LinkStrength>
+  </NetworkInfo>
+  </rainforest>`)
+
+	record := httptest.NewRecorder()
+	Prometheus.ServeHTTP(record, &http.Request{Method: "GET", URL: &url.URL{Path: "/metrics/prometheus"}})
+	out := record.Body.String()
+	labels := `{device="00:15:8d:00:00:00:00:04",gateway="f0:ad:4e:00:ce:69",meter="00:17:8d:00:00:00:00:04"}`
+	for _, line := range []string{
+		"# TYPE eagle_demand_watts gauge",
+		"eagle_demand_watts" + labels + " 5944",
+		`eagle_price{currency="CAD",device="00:15:8d:00:00:00:00:04",gateway="f0:ad:4e:00:ce:69",meter="00:17:8d:00:00:00:00:04"} 0.0797`,
+		"eagle_price_tier" + labels + " 2",
+		"eagle_link_strength" + labels + " 100",
+		`eagle_connected{device="00:15:8d:00:00:00:00:04",gateway="f0:ad:4e:00:ce:69"} 1`,
+		`eagle_status_changes_total{device="00:15:8d:00:00:00:00:04",gateway="f0:ad:4e:00:ce:69",status="Connected"} 1`,
+		"# TYPE eagle_fragments_total counter",
+		`eagle_fragments_total{gateway="f0:ad:4e:00:ce:69",type="NetworkInfo"} 2`,
+		`eagle_fragments_total{gateway="f0:ad:4e:00:ce:69",type="PriceCluster"} 1`,
+		"# TYPE eagle_summation_delivered_kwh gauge",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	got := renderLabels([]string{"rate", `Block "1"` + "\n", "device", `a\b`})
+	expected := `{device="a\\b",rate="Block \"1\"\n"}`
+	if got != expected {
+		t.Errorf("Got %s instead of %s", got, expected)
+	}
+}
+
+func TestPrometheusDeviceInfoUpgrade(t *testing.T) {
+	saved := Prometheus
+	defer func() { Prometheus = saved }()
+	Prometheus = NewExporter()
+	postFragment(t, deviceInfo)
+	postFragment(t, strings.Replace(deviceInfo, "1.4.47 (6798)", "1.4.48 (6812)", 1))
+	buf := &bytes.Buffer{}
+	Prometheus.writeTo(buf)
+	out := buf.String()
+	if strings.Contains(out, `fw_version="1.4.47 (6798)"`) || !strings.Contains(out, `fw_version="1.4.48 (6812)"`) {
+		t.Errorf("Expected only the upgraded firmware in:\n%s", out)
+	}
+}
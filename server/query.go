@@ -0,0 +1,281 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Query selects readings for GET /metrics. Without any series the raw
+// readings are returned; otherwise each series is extracted for each meter
+// and, if Step is set, aggregated into buckets of that size.
+type Query struct {
+	From time.Time
+	To   time.Time
+	// Gateway and Meter only include readings from that EAGLE or meter
+	Gateway string
+	Meter   string
+	// Allowed limits the meters to those an API key may read; empty allows
+	// them all
+	Allowed []string
+	Series  []string
+	Step    time.Duration
+	Agg     string
+	Offset  int
+	Limit   int
+}
+
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type Series struct {
+	Name    string  `json:"name"`
+	Gateway string  `json:"gateway,omitempty"`
+	Meter   string  `json:"meter,omitempty"`
+	Agg     string  `json:"agg,omitempty"`
+	Points  []Point `json:"points"`
+}
+
+type QueryResult struct {
+	Series []Series `json:"series"`
+	// Offset of the next page, if there is one
+	Next int `json:"next,omitempty"`
+}
+
+// Extract the value of a series from a reading
+var seriesValues = map[string]func(Reading) float64{
+	"demand":    func(r Reading) float64 { return float64(r.Demand) },
+	"price":     func(r Reading) float64 { return r.Price.Float() },
+	"delivered": func(r Reading) float64 { return float64(r.Delivered) },
+	"received":  func(r Reading) float64 { return float64(r.Received) },
+}
+
+// Series names that stand for more than one series
+var seriesAliases = map[string][]string{
+	"summation": {"delivered", "received"},
+}
+
+// An aggregation reduces the points in a bucket to a single value. The end of
+// the bucket is passed so time weighted aggregations know how long the last
+// point lasted.
+type aggregation func(points []Point, end time.Time) float64
+
+var aggregations = map[string]aggregation{
+	"avg": func(points []Point, end time.Time) float64 {
+		return sum(points) / float64(len(points))
+	},
+	"sum": func(points []Point, end time.Time) float64 {
+		return sum(points)
+	},
+	"min": func(points []Point, end time.Time) float64 {
+		min := math.Inf(1)
+		for _, p := range points {
+			min = math.Min(min, p.Value)
+		}
+		return min
+	},
+	"max": func(points []Point, end time.Time) float64 {
+		max := math.Inf(-1)
+		for _, p := range points {
+			max = math.Max(max, p.Value)
+		}
+		return max
+	},
+	"last": func(points []Point, end time.Time) float64 {
+		return points[len(points)-1].Value
+	},
+	// Integral over time in value-hours, e.g. kWh from kW. Each point holds
+	// its value until the next one.
+	"energy": func(points []Point, end time.Time) float64 {
+		energy := 0.0
+		for i, p := range points {
+			next := end
+			if i+1 < len(points) {
+				next = points[i+1].Time
+			}
+			energy += p.Value * next.Sub(p.Time).Hours()
+		}
+		return energy
+	},
+}
+
+func sum(points []Point) float64 {
+	total := 0.0
+	for _, p := range points {
+		total += p.Value
+	}
+	return total
+}
+
+const DefaultQueryLimit = 10000
+
+// ParseQuery reads a Query from the URL parameters from, to, gateway, meter,
+// series, step, agg, offset and limit. Times are either RFC 3339 or seconds
+// since the Unix epoch, and MAC addresses are either colon separated or hex
+// like the EAGLE sends them.
+func ParseQuery(values url.Values) (Query, error) {
+	q := Query{Agg: "avg", Limit: DefaultQueryLimit}
+	var err error
+	if v := values.Get("from"); v != "" {
+		if q.From, err = parseQueryTime(v); err != nil {
+			return q, fmt.Errorf("from: %v", err)
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = parseQueryTime(v); err != nil {
+			return q, fmt.Errorf("to: %v", err)
+		}
+	}
+	if v := values.Get("gateway"); v != "" {
+		if q.Gateway, err = ParseMacAddr(v); err != nil {
+			return q, fmt.Errorf("gateway: %v", err)
+		}
+	}
+	if v := values.Get("meter"); v != "" {
+		if q.Meter, err = ParseMacAddr(v); err != nil {
+			return q, fmt.Errorf("meter: %v", err)
+		}
+	}
+	if v := values.Get("series"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if names, ok := seriesAliases[name]; ok {
+				q.Series = append(q.Series, names...)
+			} else if _, ok := seriesValues[name]; ok {
+				q.Series = append(q.Series, name)
+			} else {
+				return q, fmt.Errorf("unknown series %q", name)
+			}
+		}
+	}
+	if v := values.Get("step"); v != "" {
+		if q.Step, err = time.ParseDuration(v); err != nil || q.Step <= 0 {
+			return q, fmt.Errorf("invalid step %q", v)
+		}
+	}
+	if v := values.Get("agg"); v != "" {
+		if _, ok := aggregations[v]; !ok {
+			return q, fmt.Errorf("unknown aggregation %q", v)
+		}
+		q.Agg = v
+	}
+	if v := values.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return q, nil
+}
+
+func parseQueryTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// ParseMacAddr reads a MAC address that is either colon separated or hex like
+// the EAGLE sends them, and returns it colon separated
+func ParseMacAddr(v string) (string, error) {
+	if strings.Contains(v, ":") {
+		mac, err := net.ParseMAC(v)
+		return mac.String(), err
+	}
+	mac := MacAddrHex{}
+	err := mac.UnmarshalText([]byte(v))
+	return mac.String(), err
+}
+
+// Filter keeps the readings from the gateway and meter asked for
+func (q Query) Filter(readings []Reading) []Reading {
+	if q.Gateway == "" && q.Meter == "" && len(q.Allowed) == 0 {
+		return readings
+	}
+	allowed := APIKey{Meters: q.Allowed}
+	result := []Reading{}
+	for _, r := range readings {
+		if (q.Gateway == "" || r.Gateway == q.Gateway) && (q.Meter == "" || r.Meter == q.Meter) && allowed.AllowsMeter(r.Meter) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// Page returns the part of the readings selected by Offset and Limit, and the
+// offset of the next page if there is one
+func (q Query) Page(readings []Reading) ([]Reading, int) {
+	start, end, next := q.bounds(len(readings))
+	return readings[start:end], next
+}
+
+func (q Query) bounds(n int) (start, end, next int) {
+	start = q.Offset
+	if start > n {
+		start = n
+	}
+	end = start + q.Limit
+	if end < n {
+		next = end
+	} else {
+		end = n
+	}
+	return start, end, next
+}
+
+// Run extracts and aggregates the requested series of each meter from the
+// readings, which must be oldest first. A series only has points from the
+// readings that set it, not the ones that carry its last value forward.
+func (q Query) Run(readings []Reading) QueryResult {
+	result := QueryResult{Series: []Series{}}
+	keys, meters := partition(readings)
+	for _, key := range keys {
+		readings := meters[key]
+		for _, name := range q.Series {
+			value := seriesValues[name]
+			points := []Point{}
+			for _, r := range readings {
+				if r.Sets(name) {
+					points = append(points, Point{r.Time, value(r)})
+				}
+			}
+			series := Series{Name: name, Gateway: key.Gateway, Meter: key.Meter}
+			if q.Step > 0 {
+				series.Agg = q.Agg
+				points = q.aggregate(points)
+			}
+			start, end, next := q.bounds(len(points))
+			series.Points = points[start:end]
+			if next > result.Next {
+				result.Next = next
+			}
+			result.Series = append(result.Series, series)
+		}
+	}
+	return result
+}
+
+// Group points into Step sized buckets and aggregate each one
+func (q Query) aggregate(points []Point) []Point {
+	agg := aggregations[q.Agg]
+	result := []Point{}
+	for start := 0; start < len(points); {
+		bucket := points[start].Time.Truncate(q.Step)
+		end := start
+		for end < len(points) && points[end].Time.Before(bucket.Add(q.Step)) {
+			end++
+		}
+		result = append(result, Point{bucket, agg(points[start:end], bucket.Add(q.Step))})
+		start = end
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var queryStart = time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// A reading every minute for an hour with demand stepping up each minute
+func queryReadings() []Reading {
+	readings := []Reading{}
+	for i := 0; i < 60; i++ {
+		readings = append(readings, Reading{
+			Time:      queryStart.Add(time.Duration(i) * time.Minute),
+			Demand:    Power(i),
+			Delivered: Energy(i) / 10,
+		})
+	}
+	return readings
+}
+
+func TestQueryAggregations(t *testing.T) {
+	tests := []struct {
+		agg      string
+		expected []float64
+	}{
+		{"avg", []float64{7, 22, 37, 52}},
+		{"min", []float64{0, 15, 30, 45}},
+		{"max", []float64{14, 29, 44, 59}},
+		{"last", []float64{14, 29, 44, 59}},
+		{"sum", []float64{105, 330, 555, 780}},
+		{"energy", []float64{1.75, 5.5, 9.25, 13}},
+	}
+	for _, test := range tests {
+		q, err := ParseQuery(url.Values{"series": {"demand"}, "step": {"15m"}, "agg": {test.agg}})
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		result := q.Run(queryReadings())
+		points := result.Series[0].Points
+		if len(points) != len(test.expected) {
+			t.Errorf("%s: got %d points instead of %d", test.agg, len(points), len(test.expected))
+			continue
+		}
+		for i, p := range points {
+			if math.Abs(p.Value-test.expected[i]) > 1e-9 {
+				t.Errorf("%s: bucket %d is %v not %v", test.agg, i, p.Value, test.expected[i])
+			}
+			if !p.Time.Equal(queryStart.Add(time.Duration(i) * 15 * time.Minute)) {
+				t.Errorf("%s: bucket %d starts at %v", test.agg, i, p.Time)
+			}
+		}
+	}
+}
+
+func TestQueryCarriedForward(t *testing.T) {
+	readings := []Reading{
+		// A price before any demand, and a price carrying the demand forward
+		{Time: queryStart, Price: Price{Money{797, 4, cad}}, Fragment: "PriceCluster"},
+		{Time: queryStart.Add(time.Minute), Demand: 1, Fragment: "InstantaneousDemand"},
+		{Time: queryStart.Add(2 * time.Minute), Demand: 1, Price: Price{Money{900, 4, cad}}, Fragment: "PriceCluster"},
+		{Time: queryStart.Add(3 * time.Minute), Demand: 3, Price: Price{Money{900, 4, cad}}, Fragment: "InstantaneousDemand"},
+	}
+	q, _ := ParseQuery(url.Values{"series": {"demand,price"}, "step": {"1h"}})
+	result := q.Run(readings)
+	if len(result.Series) != 2 {
+		t.Fatalf("Got %+v", result)
+	}
+	if points := result.Series[0].Points; len(points) != 1 || points[0].Value != 2 {
+		t.Errorf("Got demand %+v instead of an average of 2", points)
+	}
+	if points := result.Series[1].Points; len(points) != 1 || math.Abs(points[0].Value-0.08485) > 1e-9 {
+		t.Errorf("Got price %+v instead of an average of 0.08485", points)
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	q, _ := ParseQuery(url.Values{"series": {"summation"}, "offset": {"50"}, "limit": {"5"}})
+	result := q.Run(queryReadings())
+	if len(result.Series) != 2 || result.Series[1].Name != "received" {
+		t.Fatalf("Expected delivered and received series, got %+v", result.Series)
+	}
+	points := result.Series[0].Points
+	if len(points) != 5 || points[0].Value != 5 || result.Next != 55 {
+		t.Errorf("Got %+v next %d", points, result.Next)
+	}
+	q.Offset = 55
+	if _, next := q.Page(queryReadings()); next != 0 {
+		t.Errorf("Got a next page after the last one: %d", next)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, bad := range []url.Values{
+		{"from": {"yesterday"}},
+		{"series": {"voltage"}},
+		{"step": {"-5m"}},
+		{"agg": {"median"}},
+		{"limit": {"0"}},
+	} {
+		if _, err := ParseQuery(bad); err == nil {
+			t.Errorf("Expected an error from %v", bad)
+		}
+	}
+}
+
+func TestGetMetricsQuery(t *testing.T) {
+	saved := Readings
+	defer func() { Readings = saved }()
+	Readings = NewMemoryStore(100)
+	for _, r := range queryReadings() {
+		Readings.Append(r)
+	}
+	from := queryStart.Add(30 * time.Minute).Format(time.RFC3339)
+	record := httptest.NewRecorder()
+	req := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/metrics", RawQuery: "series=demand&step=1h&agg=max&from=" + from},
+	}
+	MetricsHandler(record, req)
+	if record.Code != 200 {
+		t.Fatalf("Response was %d not 200", record.Code)
+	}
+	result := QueryResult{}
+	if err := json.Unmarshal(record.Body.Bytes(), &result); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	points := result.Series[0].Points
+	if len(points) != 1 || points[0].Value != 59 {
+		t.Errorf("Got %+v", points)
+	}
+
+	record = httptest.NewRecorder()
+	req.URL.RawQuery = "step=fast"
+	MetricsHandler(record, req)
+	if record.Code != 400 {
+		t.Errorf("Response was %d not 400", record.Code)
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type QueueOptions struct {
+	// Size is the number of batches held in memory waiting to be sent
+	Size int
+	// Retries is how many times a failed batch is retried before it is
+	// spilled or dropped
+	Retries int
+	// Backoff is the delay before the first retry; it doubles with each
+	// retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// SpillDir is where batches go when the queue is full or they run out of
+	// retries. They are sent again once the sink is working. Without a
+	// SpillDir those batches are dropped.
+	SpillDir string
+	// SpillLimit is the most batches kept in SpillDir
+	SpillLimit int
+}
+
+var DefaultQueueOptions = QueueOptions{
+	Size:       1000,
+	Retries:    5,
+	Backoff:    time.Second,
+	MaxBackoff: time.Minute,
+	SpillLimit: 100000,
+}
+
+// QueueStats counts what happened to the batches given to a QueuedSink
+type QueueStats struct {
+	Queued   int64 `json:"queued"`
+	Sent     int64 `json:"sent"`
+	Retried  int64 `json:"retried"`
+	Spilled  int64 `json:"spilled"`
+	Replayed int64 `json:"replayed"`
+	Dropped  int64 `json:"dropped"`
+}
+
+var ErrDropped = errors.New("queue full, metrics dropped")
+
+// QueuedSink sends metrics to another sink from a background goroutine so a
+// slow or unreachable backend never holds up the caller. Batches that don't
+// fit in the queue are spilled by another goroutine, so the caller never
+// waits on the disk either.
+type QueuedSink struct {
+	sink     Sink
+	opts     QueueOptions
+	queue    chan []Metric
+	overflow chan []Metric // waiting to be spilled
+	stop     chan struct{}
+	done     chan struct{}
+	spilling chan struct{} // closed once the overflow is all spilled
+	spillMu  sync.Mutex
+	pending  bool // there may be spilled batches to replay
+	stats    QueueStats
+}
+
+func NewQueuedSink(sink Sink, opts QueueOptions) *QueuedSink {
+	if opts.Size < 1 {
+		opts.Size = DefaultQueueOptions.Size
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultQueueOptions.Backoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = opts.Backoff
+	}
+	if opts.SpillLimit < 1 {
+		opts.SpillLimit = DefaultQueueOptions.SpillLimit
+	}
+	q := &QueuedSink{
+		sink:     sink,
+		opts:     opts,
+		queue:    make(chan []Metric, opts.Size),
+		overflow: make(chan []Metric, opts.Size),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		spilling: make(chan struct{}),
+		// Batches may have been left behind by a previous process
+		pending: opts.SpillDir != "",
+	}
+	go q.run()
+	go q.spillOverflow()
+	return q
+}
+
+// Send queues the metrics without waiting for them to be delivered. If the
+// queue is full they are handed over to be spilled to disk, or dropped if
+// there is no SpillDir or the spilling has fallen behind too.
+func (q *QueuedSink) Send(metrics []Metric) error {
+	select {
+	case q.queue <- metrics:
+		atomic.AddInt64(&q.stats.Queued, 1)
+		return nil
+	default:
+	}
+	if q.opts.SpillDir != "" {
+		select {
+		case q.overflow <- metrics:
+			return nil
+		default:
+		}
+	}
+	atomic.AddInt64(&q.stats.Dropped, 1)
+	return ErrDropped
+}
+
+func (q *QueuedSink) Stats() QueueStats {
+	return QueueStats{
+		Queued:   atomic.LoadInt64(&q.stats.Queued),
+		Sent:     atomic.LoadInt64(&q.stats.Sent),
+		Retried:  atomic.LoadInt64(&q.stats.Retried),
+		Spilled:  atomic.LoadInt64(&q.stats.Spilled),
+		Replayed: atomic.LoadInt64(&q.stats.Replayed),
+		Dropped:  atomic.LoadInt64(&q.stats.Dropped),
+	}
+}
+
+// Close stops the background goroutine, spilling anything still queued, and
+// closes the sink it wraps if that needs to be
+func (q *QueuedSink) Close() error {
+	close(q.stop)
+	<-q.done
+	<-q.spilling
+	if closer, ok := q.sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (q *QueuedSink) run() {
+	defer close(q.done)
+	replay := time.NewTicker(q.opts.MaxBackoff)
+	defer replay.Stop()
+	for {
+		select {
+		case metrics := <-q.queue:
+			atomic.AddInt64(&q.stats.Queued, -1)
+			if q.deliver(metrics) {
+				q.replay()
+			} else {
+				q.spill(metrics)
+			}
+		case <-replay.C:
+			q.replay()
+		case <-q.stop:
+			for {
+				select {
+				case metrics := <-q.queue:
+					atomic.AddInt64(&q.stats.Queued, -1)
+					q.spill(metrics)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Spill the batches that didn't fit in the queue
+func (q *QueuedSink) spillOverflow() {
+	defer close(q.spilling)
+	for {
+		select {
+		case metrics := <-q.overflow:
+			q.spill(metrics)
+		case <-q.stop:
+			for {
+				select {
+				case metrics := <-q.overflow:
+					q.spill(metrics)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Try to send a batch, backing off exponentially between retries. Returns
+// false if it never got through.
+func (q *QueuedSink) deliver(metrics []Metric) bool {
+	backoff := q.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := q.sink.Send(metrics)
+		if err == nil {
+			atomic.AddInt64(&q.stats.Sent, 1)
+			return true
+		}
+		if attempt >= q.opts.Retries {
+			log.Printf("Giving up on %d metrics: %v", len(metrics), err)
+			return false
+		}
+		atomic.AddInt64(&q.stats.Retried, 1)
+		select {
+		case <-time.After(backoff):
+		case <-q.stop:
+			return false
+		}
+		if backoff *= 2; backoff > q.opts.MaxBackoff {
+			backoff = q.opts.MaxBackoff
+		}
+	}
+}
+
+var spillSeq int64
+
+func (q *QueuedSink) spill(metrics []Metric) error {
+	if q.opts.SpillDir == "" {
+		atomic.AddInt64(&q.stats.Dropped, 1)
+		return ErrDropped
+	}
+	q.spillMu.Lock()
+	defer q.spillMu.Unlock()
+	err := os.MkdirAll(q.opts.SpillDir, 0755)
+	if err == nil {
+		if files, _ := q.spilled(); len(files) >= q.opts.SpillLimit {
+			err = fmt.Errorf("%d batches already spilled", len(files))
+		}
+	}
+	var buf []byte
+	if err == nil {
+		buf, err = json.Marshal(metrics)
+	}
+	if err == nil {
+		name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), atomic.AddInt64(&spillSeq, 1)%1000000)
+		path := filepath.Join(q.opts.SpillDir, name)
+		if err = writeFileSync(path+tmpExt, buf); err == nil {
+			err = os.Rename(path+tmpExt, path)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&q.stats.Dropped, 1)
+		log.Printf("Dropping %d metrics: %v", len(metrics), err)
+		return ErrDropped
+	}
+	q.pending = true
+	atomic.AddInt64(&q.stats.Spilled, 1)
+	return nil
+}
+
+// The spilled batches, oldest first; callers must hold spillMu
+func (q *QueuedSink) spilled() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(q.opts.SpillDir, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+// Send spilled batches oldest first, stopping at the first failure
+func (q *QueuedSink) replay() {
+	q.spillMu.Lock()
+	if !q.pending {
+		q.spillMu.Unlock()
+		return
+	}
+	q.pending = false
+	files, _ := q.spilled()
+	q.spillMu.Unlock()
+	for _, path := range files {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		metrics := []Metric{}
+		if err := json.Unmarshal(buf, &metrics); err != nil {
+			log.Printf("Discarding unreadable spill file %s: %v", path, err)
+			os.Remove(path)
+			continue
+		}
+		if err := q.sink.Send(metrics); err != nil {
+			q.spillMu.Lock()
+			q.pending = true
+			q.spillMu.Unlock()
+			return
+		}
+		os.Remove(path)
+		atomic.AddInt64(&q.stats.Replayed, 1)
+	}
+}
+
+// Read QueueOptions from the queue_size, retries, backoff, max_backoff,
+// spill_dir and spill_limit settings of a sink
+func queueOptions(config SinkConfig, opts QueueOptions) (QueueOptions, error) {
+	ints := map[string]*int{
+		"queue_size":  &opts.Size,
+		"retries":     &opts.Retries,
+		"spill_limit": &opts.SpillLimit,
+	}
+	for key, field := range ints {
+		if v, ok := config[key]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %v", key, err)
+			}
+			*field = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"backoff":     &opts.Backoff,
+		"max_backoff": &opts.MaxBackoff,
+	}
+	for key, field := range durations {
+		if v, ok := config[key]; ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %v", key, err)
+			}
+			*field = d
+		}
+	}
+	if v, ok := config["spill_dir"]; ok {
+		opts.SpillDir = v
+	}
+	return opts, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sink that fails until it is told to work, and can be made to block
+type flakySink struct {
+	mu       sync.Mutex
+	failures int
+	sent     [][]Metric
+	block    chan struct{}
+}
+
+func (s *flakySink) Send(metrics []Metric) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures != 0 {
+		s.failures--
+		return errors.New("backend down")
+	}
+	s.sent = append(s.sent, metrics)
+	return nil
+}
+
+func (s *flakySink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueuedSinkRetries(t *testing.T) {
+	sink := &flakySink{failures: 3}
+	q := NewQueuedSink(sink, QueueOptions{Retries: 5, Backoff: time.Millisecond})
+	defer q.Close()
+	if err := q.Send([]Metric{{Name: "demand", Value: 1}}); err != nil {
+		t.Errorf("error: %v", err)
+	}
+	waitFor(t, "delivery", func() bool { return sink.count() == 1 })
+	stats := q.Stats()
+	if stats.Retried != 3 || stats.Sent != 1 || stats.Dropped != 0 {
+		t.Errorf("Got stats %+v", stats)
+	}
+}
+
+func TestQueuedSinkSpills(t *testing.T) {
+	dir := t.TempDir()
+	sink := &flakySink{failures: -1}
+	opts := QueueOptions{Retries: 1, Backoff: time.Millisecond, MaxBackoff: time.Hour, SpillDir: dir}
+	q := NewQueuedSink(sink, opts)
+	q.Send([]Metric{{Name: "demand", Value: 1}})
+	q.Send([]Metric{{Name: "demand", Value: 2}})
+	waitFor(t, "spill", func() bool { return q.Stats().Spilled == 2 })
+	q.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Errorf("Expected 2 spill files, found %v", files)
+	}
+
+	// A new queue picks up where the old one left off once the backend is back
+	sink.mu.Lock()
+	sink.failures = 0
+	sink.mu.Unlock()
+	q = NewQueuedSink(sink, opts)
+	defer q.Close()
+	q.Send([]Metric{{Name: "demand", Value: 3}})
+	waitFor(t, "replay", func() bool { return sink.count() == 3 })
+	if sink.sent[1][0].Value != 1 || sink.sent[2][0].Value != 2 {
+		t.Errorf("Spilled batches replayed out of order: %+v", sink.sent)
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 0 {
+		t.Errorf("Replayed spill files left behind: %v", files)
+	}
+}
+
+func TestQueuedSinkSpillsOverflow(t *testing.T) {
+	dir := t.TempDir()
+	sink := &flakySink{block: make(chan struct{})}
+	q := NewQueuedSink(sink, QueueOptions{Size: 1, SpillDir: dir})
+	// One batch stuck in the sink and one in the queue; the rest are handed
+	// over to be spilled without the caller waiting for the disk
+	for i := 0; i < 4; i++ {
+		if err := q.Send([]Metric{{Name: "demand", Value: float64(i)}}); err != nil {
+			t.Errorf("Batch %d: %v", i, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitFor(t, "spill", func() bool { return q.Stats().Spilled == 2 })
+	if stats := q.Stats(); stats.Dropped != 0 {
+		t.Errorf("Got stats %+v", stats)
+	}
+	close(sink.block)
+	q.Close()
+}
+
+func TestQueuedSinkDrops(t *testing.T) {
+	sink := &flakySink{block: make(chan struct{})}
+	q := NewQueuedSink(sink, QueueOptions{Size: 1})
+	// One batch stuck in the sink, one in the queue, the rest dropped
+	var dropped int
+	for i := 0; i < 5; i++ {
+		if err := q.Send([]Metric{{Name: "demand"}}); err == ErrDropped {
+			dropped++
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if dropped < 3 || q.Stats().Dropped != int64(dropped) {
+		t.Errorf("Dropped %d, stats %+v", dropped, q.Stats())
+	}
+	close(sink.block)
+	q.Close()
+}
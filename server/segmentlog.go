@@ -0,0 +1,654 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Backend persists readings so they survive a restart
+type Backend interface {
+	// Write durably records a reading before returning
+	Write(r Reading) error
+	// WriteBatch durably records all of the readings or, if it fails or is
+	// interrupted by a crash, none of them
+	WriteBatch(readings []Reading) error
+	// Read returns the stored readings with from <= Time < to, oldest first.
+	// A zero to means there is no upper bound.
+	Read(from, to time.Time) ([]Reading, error)
+	// Compact applies the retention policy and reclaims space
+	Compact() error
+	Close() error
+}
+
+type SegmentLogOptions struct {
+	// SegmentSize is the size in bytes at which the active segment is sealed
+	// and a new one started
+	SegmentSize int64
+	// Retention is how long readings are kept; zero keeps them forever
+	Retention time.Duration
+}
+
+const (
+	DefaultSegmentSize = 4 << 20
+	segmentExt         = ".seg"
+	tmpExt             = ".tmp"
+	indexFile          = "index.json"
+	recordHeaderSize   = 8
+)
+
+// A record cut short by a crash part way through writing it
+var errTornRecord = errors.New("torn record")
+
+// Index entry describing one segment file
+type segment struct {
+	Seq   int64     `json:"seq"`
+	Size  int64     `json:"size"`
+	Count int       `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	// Undecoded is the number of records that couldn't be read, such as
+	// ones written by another version. They are kept but skipped.
+	Undecoded int `json:"undecoded,omitempty"`
+}
+
+// One record read from a segment file
+type record struct {
+	raw      []byte // header and payload
+	readings []Reading
+	decoded  bool
+}
+
+// Count a record. The size of a batch is counted against its first reading.
+func (s *segment) addRecord(rec record) {
+	size := int64(len(rec.raw))
+	if !rec.decoded {
+		s.Undecoded++
+		s.Size += size
+		return
+	}
+	for _, r := range rec.readings {
+		s.add(r, size)
+		size = 0
+	}
+}
+
+func (s *segment) add(r Reading, size int64) {
+	if s.Count == 0 || r.Time.Before(s.First) {
+		s.First = r.Time
+	}
+	if s.Count == 0 || r.Time.After(s.Last) {
+		s.Last = r.Time
+	}
+	s.Count++
+	s.Size += size
+}
+
+func (s *segment) empty() bool {
+	return s.Count == 0 && s.Undecoded == 0
+}
+
+// Whether some of the readings are older than cutoff
+func (s *segment) expiring(cutoff time.Time) bool {
+	return s.Count > 0 && s.First.Before(cutoff)
+}
+
+// Whether all of the readings are older than cutoff, with no undecoded
+// records that might not be
+func (s *segment) expired(cutoff time.Time) bool {
+	return s.empty() || (s.Undecoded == 0 && s.Last.Before(cutoff))
+}
+
+func (s *segment) overlaps(from, to time.Time) bool {
+	if s.Count == 0 {
+		return false
+	}
+	return !s.Last.Before(from) && (to.IsZero() || s.First.Before(to))
+}
+
+type segmentIndex struct {
+	MaxSeq   int64      `json:"maxSeq"`
+	Segments []*segment `json:"segments"`
+}
+
+// SegmentLog is an append-only log of readings split into segment files. Each
+// record, either one reading or a batch of them, is length prefixed and
+// checksummed so a torn write at the end of the log is detected and discarded
+// on open. An index of the time range covered
+// by each segment is kept in index.json so reads only open the segments they
+// need.
+//
+// The index is also the record of which segments are live: compaction writes
+// its output to temporary files, commits the new index and only then renames
+// the output into place and removes the segments it replaced. Opening a log
+// finishes or discards any compaction that was interrupted part way through.
+type SegmentLog struct {
+	mu       sync.Mutex
+	dir      string
+	opts     SegmentLogOptions
+	segments []*segment // oldest first, the last one is active
+	active   *os.File
+	maxSeq   int64
+}
+
+func OpenSegmentLog(dir string, opts SegmentLogOptions) (*SegmentLog, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &SegmentLog{dir: dir, opts: opts}
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *SegmentLog) segmentPath(seq int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016d%s", seq, segmentExt))
+}
+
+// Rebuild the list of live segments from the index and the directory
+func (l *SegmentLog) recover() error {
+	index := segmentIndex{}
+	buf, err := os.ReadFile(filepath.Join(l.dir, indexFile))
+	if err == nil {
+		err = json.Unmarshal(buf, &index)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %v", indexFile, err)
+	}
+	listed := make(map[int64]*segment)
+	for _, s := range index.Segments {
+		listed[s.Seq] = s
+		// Finish a compaction that committed its index but was
+		// interrupted before renaming its output
+		tmp := l.segmentPath(s.Seq) + tmpExt
+		if _, err := os.Stat(tmp); err == nil {
+			if err := os.Rename(tmp, l.segmentPath(s.Seq)); err != nil {
+				return err
+			}
+		}
+	}
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[int64]int64)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			// Output of a compaction that never committed
+			os.Remove(filepath.Join(l.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := listed[seq]; !ok && seq <= index.MaxSeq {
+			// Replaced by a committed compaction
+			os.Remove(filepath.Join(l.dir, name))
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			sizes[seq] = info.Size()
+		}
+	}
+	// Segments keep their index order, which compaction may have made
+	// different from their sequence order. Segments created since the index
+	// was last written follow in sequence order.
+	l.maxSeq = index.MaxSeq
+	unlisted := []int64{}
+	for seq := range sizes {
+		if _, ok := listed[seq]; !ok {
+			unlisted = append(unlisted, seq)
+		}
+	}
+	sort.Slice(unlisted, func(i, j int) bool { return unlisted[i] < unlisted[j] })
+	for _, s := range index.Segments {
+		size, ok := sizes[s.Seq]
+		if !ok {
+			continue
+		}
+		if size != s.Size {
+			// Written to since the index was, most likely the
+			// active segment
+			if s, err = l.scan(s.Seq); err != nil {
+				return err
+			}
+		}
+		l.segments = append(l.segments, s)
+	}
+	for _, seq := range unlisted {
+		s, err := l.scan(seq)
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, s)
+		l.maxSeq = seq
+	}
+	for _, s := range l.segments {
+		if s.Undecoded > 0 {
+			log.Printf("Segment %d has %d records that can't be read; they are kept but skipped", s.Seq, s.Undecoded)
+		}
+	}
+	if len(l.segments) == 0 {
+		return l.rotate()
+	}
+	active := l.segments[len(l.segments)-1]
+	l.active, err = os.OpenFile(l.segmentPath(active.Seq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	return l.writeIndex()
+}
+
+// Read a whole segment to build its index entry, truncating any torn record
+// at the end of the file
+func (l *SegmentLog) scan(seq int64) (*segment, error) {
+	s := &segment{Seq: seq}
+	path := l.segmentPath(seq)
+	err := readSegment(path, s.addRecord)
+	if err == errTornRecord {
+		err = os.Truncate(path, s.Size)
+	}
+	return s, err
+}
+
+// Read the records of a segment in order. A short record, or one with the
+// wrong checksum at the very end of the file, is a torn write and gives
+// errTornRecord. A bad checksum anywhere else is an error, as is a length
+// running past the end of the file with whole records after it, so nothing
+// after it is ever truncated. Records that pass their checksum but can't be decoded
+// are passed to fn with decoded false.
+// Whether a whole record with a good checksum starts anywhere in buf
+func containsRecord(buf []byte) bool {
+	for i := 0; i+recordHeaderSize <= len(buf); i++ {
+		length := int64(binary.BigEndian.Uint32(buf[i : i+4]))
+		end := int64(i) + recordHeaderSize + length
+		if length == 0 || end > int64(len(buf)) {
+			continue
+		}
+		if crc32.ChecksumIEEE(buf[i+recordHeaderSize:end]) == binary.BigEndian.Uint32(buf[i+4:i+8]) {
+			return true
+		}
+	}
+	return false
+}
+
+func readSegment(path string, fn func(rec record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(f)
+	var offset int64
+	for {
+		header := make([]byte, recordHeaderSize)
+		if _, err := io.ReadFull(in, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errTornRecord
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		end := offset + recordHeaderSize + int64(length)
+		if end > info.Size() {
+			rest, err := io.ReadAll(in)
+			if err == nil && containsRecord(rest) {
+				return fmt.Errorf("%s: bad record length at offset %d", path, offset)
+			}
+			return errTornRecord
+		}
+		raw := append(header, make([]byte, length)...)
+		if _, err := io.ReadFull(in, raw[recordHeaderSize:]); err != nil {
+			return errTornRecord
+		}
+		payload := raw[recordHeaderSize:]
+		if crc32.ChecksumIEEE(payload) != sum {
+			if end == info.Size() {
+				return errTornRecord
+			}
+			return fmt.Errorf("%s: bad checksum at offset %d", path, offset)
+		}
+		readings, err := decodePayload(payload)
+		fn(record{raw: raw, readings: readings, decoded: err == nil})
+		offset = end
+	}
+}
+
+// A payload is one reading as a JSON object or a batch as an array
+func decodePayload(payload []byte) ([]Reading, error) {
+	if len(payload) > 0 && payload[0] == '[' {
+		readings := []Reading{}
+		if err := json.Unmarshal(payload, &readings); err != nil {
+			return nil, err
+		}
+		return readings, nil
+	}
+	r := Reading{}
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return nil, err
+	}
+	return []Reading{r}, nil
+}
+
+// Encode a Reading or a []Reading as a record
+func encodeRecord(v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...), nil
+}
+
+// Atomically replace the index; callers must hold the lock
+func (l *SegmentLog) writeIndex() error {
+	buf, err := json.Marshal(segmentIndex{l.maxSeq, l.segments})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, indexFile)
+	if err := writeFileSync(path+tmpExt, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return err
+	}
+	return syncDir(l.dir)
+}
+
+func writeFileSync(path string, buf []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Replace the file at path with v as JSON in one go
+func writeJSONFile(path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(path+tmpExt, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Seal the active segment and start a new one; callers must hold the lock
+func (l *SegmentLog) rotate() error {
+	if l.active != nil {
+		if err := l.active.Close(); err != nil {
+			return err
+		}
+	}
+	l.maxSeq++
+	f, err := os.OpenFile(l.segmentPath(l.maxSeq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.active = f
+	l.segments = append(l.segments, &segment{Seq: l.maxSeq})
+	return l.writeIndex()
+}
+
+func (l *SegmentLog) Write(r Reading) error {
+	raw, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	return l.append(record{raw: raw, readings: []Reading{r}, decoded: true})
+}
+
+// WriteBatch writes the readings as a single record, so a crash part way
+// through loses the whole batch rather than leaving some of it behind
+func (l *SegmentLog) WriteBatch(readings []Reading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	raw, err := encodeRecord(readings)
+	if err != nil {
+		return err
+	}
+	return l.append(record{raw: raw, readings: readings, decoded: true})
+}
+
+// Append a record to the active segment and sync it
+func (l *SegmentLog) append(rec record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return os.ErrClosed
+	}
+	active := l.segments[len(l.segments)-1]
+	if _, err := l.active.Write(rec.raw); err != nil {
+		// Drop whatever part of the record made it to disk
+		l.active.Truncate(active.Size)
+		return err
+	}
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	active.addRecord(rec)
+	if active.Size >= l.opts.SegmentSize {
+		return l.rotate()
+	}
+	return nil
+}
+
+func (l *SegmentLog) Read(from, to time.Time) ([]Reading, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := []Reading{}
+	for _, s := range l.segments {
+		if !s.overlaps(from, to) {
+			continue
+		}
+		err := readSegment(l.segmentPath(s.Seq), func(rec record) {
+			for _, r := range rec.readings {
+				if !r.Time.Before(from) && (to.IsZero() || r.Time.Before(to)) {
+					result = append(result, r)
+				}
+			}
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+// Compact drops segments that have fallen entirely outside the retention
+// period and rewrites sealed segments that are partially expired or small,
+// merging neighbours together up to the segment size.
+func (l *SegmentLog) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return os.ErrClosed
+	}
+	var cutoff time.Time
+	if l.opts.Retention > 0 {
+		cutoff = time.Now().Add(-l.opts.Retention)
+	}
+	sealed := l.segments[:len(l.segments)-1]
+	live := []*segment{}
+	obsolete := []int64{}
+	written := []int64{}
+	batch := []*segment{}
+	var batchSize int64
+	flush := func() error {
+		defer func() { batch, batchSize = nil, 0 }()
+		if len(batch) == 0 {
+			return nil
+		}
+		if len(batch) == 1 && !batch[0].expiring(cutoff) {
+			live = append(live, batch[0])
+			return nil
+		}
+		merged, err := l.merge(batch, cutoff)
+		if err != nil {
+			return err
+		}
+		for _, s := range batch {
+			obsolete = append(obsolete, s.Seq)
+		}
+		if merged.empty() {
+			return os.Remove(l.segmentPath(merged.Seq) + tmpExt)
+		}
+		written = append(written, merged.Seq)
+		live = append(live, merged)
+		return nil
+	}
+	for _, s := range sealed {
+		switch {
+		case s.expired(cutoff):
+			if err := flush(); err != nil {
+				return err
+			}
+			obsolete = append(obsolete, s.Seq)
+		case s.expiring(cutoff) || s.Size < l.opts.SegmentSize/2:
+			if batchSize+s.Size > l.opts.SegmentSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			batch = append(batch, s)
+			batchSize += s.Size
+		default:
+			if err := flush(); err != nil {
+				return err
+			}
+			live = append(live, s)
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if len(obsolete) == 0 {
+		return nil
+	}
+	l.segments = append(live, l.segments[len(l.segments)-1])
+	if err := l.writeIndex(); err != nil {
+		return err
+	}
+	for _, seq := range written {
+		path := l.segmentPath(seq)
+		if err := os.Rename(path+tmpExt, path); err != nil {
+			return err
+		}
+	}
+	for _, seq := range obsolete {
+		os.Remove(l.segmentPath(seq))
+	}
+	return syncDir(l.dir)
+}
+
+// Write the unexpired readings from a batch of segments to a new temporary
+// segment file; callers must hold the lock
+func (l *SegmentLog) merge(batch []*segment, cutoff time.Time) (*segment, error) {
+	l.maxSeq++
+	merged := &segment{Seq: l.maxSeq}
+	f, err := os.Create(l.segmentPath(merged.Seq) + tmpExt)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := bufio.NewWriter(f)
+	var writeErr error
+	for _, s := range batch {
+		err = readSegment(l.segmentPath(s.Seq), func(rec record) {
+			if writeErr != nil {
+				return
+			}
+			if !rec.decoded {
+				// Copied as it is, since it can't be checked for expiry
+				if _, writeErr = out.Write(rec.raw); writeErr == nil {
+					merged.addRecord(rec)
+				}
+				return
+			}
+			for _, r := range rec.readings {
+				if r.Time.Before(cutoff) || writeErr != nil {
+					continue
+				}
+				var raw []byte
+				if raw, writeErr = encodeRecord(r); writeErr == nil {
+					_, writeErr = out.Write(raw)
+					merged.add(r, int64(len(raw)))
+				}
+			}
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return nil, err
+	}
+	return merged, f.Sync()
+}
+
+func (l *SegmentLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return nil
+	}
+	err := l.writeIndex()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	l.active = nil
+	return err
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeReadings(t *testing.T, l *SegmentLog, start time.Time, n int) {
+	for i := 0; i < n; i++ {
+		r := Reading{Time: start.Add(time.Duration(i) * time.Minute), Demand: Power(i)}
+		if err := l.Write(r); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+}
+
+func TestSegmentLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenSegmentLog(dir, SegmentLogOptions{SegmentSize: 512})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 50)
+	if len(l.segments) < 2 {
+		t.Errorf("Expected several segments, got %d", len(l.segments))
+	}
+	l.Close()
+
+	l, err = OpenSegmentLog(dir, SegmentLogOptions{SegmentSize: 512})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	all, err := l.Read(time.Time{}, time.Time{})
+	if err != nil || len(all) != 50 {
+		t.Fatalf("Got %d readings (%v) instead of 50", len(all), err)
+	}
+	for i, r := range all {
+		if r.Demand != Power(i) {
+			t.Errorf("Reading %d has demand %v", i, r.Demand)
+		}
+	}
+	some, _ := l.Read(start.Add(10*time.Minute), start.Add(20*time.Minute))
+	if len(some) != 10 || some[0].Demand != 10 {
+		t.Errorf("Got %+v instead of demand 10 to 19", some)
+	}
+}
+
+func TestSegmentLogTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenSegmentLog(dir, SegmentLogOptions{})
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 3)
+	path := l.segmentPath(l.segments[0].Seq)
+	// Simulate a crash part way through appending a record
+	l.active.Write([]byte{0, 0, 0, 40, 1, 2})
+	l.active.Close()
+	l.active = nil
+
+	l, err := OpenSegmentLog(dir, SegmentLogOptions{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	writeReadings(t, l, start.Add(time.Hour), 1)
+	all, _ := l.Read(time.Time{}, time.Time{})
+	if len(all) != 4 {
+		t.Errorf("Got %d readings instead of 4", len(all))
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != l.segments[0].Size {
+		t.Errorf("Segment is %d bytes, index says %d", info.Size(), l.segments[0].Size)
+	}
+}
+
+func TestSegmentLogWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenSegmentLog(dir, SegmentLogOptions{})
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 2)
+	batch := []Reading{
+		{Time: start.Add(5 * time.Minute), Demand: 5},
+		{Time: start.Add(3 * time.Minute), Demand: 3},
+	}
+	if err := l.WriteBatch(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if l.segments[0].Count != 4 || !l.segments[0].Last.Equal(start.Add(5*time.Minute)) {
+		t.Errorf("Got index entry %+v", l.segments[0])
+	}
+	// Simulate a crash part way through appending another batch
+	record, _ := encodeRecord(batch)
+	l.active.Write(record[:len(record)-10])
+	l.active.Close()
+	l.active = nil
+
+	l, err := OpenSegmentLog(dir, SegmentLogOptions{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	all, _ := l.Read(time.Time{}, time.Time{})
+	if len(all) != 4 || all[2].Demand != 3 || all[3].Demand != 5 {
+		t.Errorf("Got %+v instead of the first batch only", all)
+	}
+}
+
+func TestSegmentLogUndecodable(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentLogOptions{SegmentSize: 2048}
+	l, _ := OpenSegmentLog(dir, opts)
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 2)
+	// A record from some other version that this one can't decode
+	foreign, _ := encodeRecord(map[string]string{"time": "yesterday"})
+	l.active.Write(foreign)
+	l.active.Close()
+	l.active = nil
+
+	l, err := OpenSegmentLog(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	writeReadings(t, l, start.Add(time.Hour), 1)
+	l.mu.Lock()
+	l.rotate()
+	l.mu.Unlock()
+	writeReadings(t, l, start.Add(2*time.Hour), 1)
+	l.mu.Lock()
+	l.rotate()
+	l.mu.Unlock()
+	if err := l.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	all, err := l.Read(time.Time{}, time.Time{})
+	if err != nil || len(all) != 4 {
+		t.Errorf("Got %+v (%v) instead of the 4 readings", all, err)
+	}
+	if len(l.segments) != 2 || l.segments[0].Undecoded != 1 {
+		t.Fatalf("Got segments %+v", l.segments)
+	}
+	buf, _ := os.ReadFile(l.segmentPath(l.segments[0].Seq))
+	if !bytes.Contains(buf, foreign) {
+		t.Errorf("Compaction dropped the undecodable record")
+	}
+}
+
+func TestSegmentLogCorruptMiddle(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenSegmentLog(dir, SegmentLogOptions{})
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 3)
+	path := l.segmentPath(l.segments[0].Seq)
+	l.Close()
+	buf, _ := os.ReadFile(path)
+	// Flip a bit in the first record, and leave the index out of date
+	buf[recordHeaderSize+2] ^= 1
+	os.WriteFile(path, append(buf, 0), 0644)
+
+	if _, err := OpenSegmentLog(dir, SegmentLogOptions{}); err == nil {
+		t.Errorf("Opened a log with a corrupt record")
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(buf)+1) {
+		t.Errorf("Segment was truncated to %d bytes", info.Size())
+	}
+}
+
+func TestSegmentLogCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenSegmentLog(dir, SegmentLogOptions{})
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 3)
+	path := l.segmentPath(l.segments[0].Seq)
+	l.Close()
+	buf, _ := os.ReadFile(path)
+	// Make the first record look longer than the whole file, and leave the
+	// index out of date
+	buf[0] = 0x7f
+	os.WriteFile(path, append(buf, 0), 0644)
+
+	if _, err := OpenSegmentLog(dir, SegmentLogOptions{}); err == nil {
+		t.Errorf("Opened a log with a corrupt record length")
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(buf)+1) {
+		t.Errorf("Segment was truncated to %d bytes", info.Size())
+	}
+}
+
+func TestSegmentLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentLogOptions{SegmentSize: 512, Retention: time.Hour}
+	l, _ := OpenSegmentLog(dir, opts)
+	start := time.Now().Add(-2 * time.Hour)
+	writeReadings(t, l, start, 120)
+	before := len(l.segments)
+	if err := l.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if len(l.segments) >= before {
+		t.Errorf("Compacting left %d of %d segments", len(l.segments), before)
+	}
+	all, _ := l.Read(time.Time{}, time.Time{})
+	if len(all) == 0 || all[0].Time.Before(start.Add(time.Hour-time.Minute)) {
+		t.Errorf("Expired readings survived compaction: %+v", all[0])
+	}
+	l.Close()
+
+	l, _ = OpenSegmentLog(dir, opts)
+	defer l.Close()
+	again, _ := l.Read(time.Time{}, time.Time{})
+	if len(again) != len(all) {
+		t.Errorf("Got %d readings after reopening instead of %d", len(again), len(all))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(files) != len(l.segments) {
+		t.Errorf("Found %d segment files for %d segments", len(files), len(l.segments))
+	}
+}
+
+func TestPersistentStore(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenSegmentLog(dir, SegmentLogOptions{})
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 10)
+	store, err := NewPersistentStore(NewMemoryStore(4), l)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	defer store.Close()
+	latest, _ := store.Latest(MeterKey{})
+	if latest.Demand != 9 {
+		t.Errorf("Got latest %+v instead of demand 9", latest)
+	}
+	if n := len(store.Range(time.Time{}, time.Time{})); n != 10 {
+		t.Errorf("Got %d readings instead of 10", n)
+	}
+	store.Append(Reading{Time: start.Add(time.Hour), Demand: 100})
+	recent := store.Range(start.Add(8*time.Minute), time.Time{})
+	if len(recent) != 3 || recent[2].Demand != 100 {
+		t.Errorf("Got %+v instead of the last three readings", recent)
+	}
+}
+
+func TestPersistentStoreMerge(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := OpenSegmentLog(dir, SegmentLogOptions{})
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	writeReadings(t, l, start, 10)
+	store, err := NewPersistentStore(NewMemoryStore(4), l)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	defer store.Close()
+	backfill := []Reading{
+		{Time: start.Add(2 * time.Minute), Demand: 100},
+		{Time: start.Add(90 * time.Second), Demand: 1.5},
+		{Time: start.Add(9*time.Minute + 30*time.Second), Demand: 9.5},
+	}
+	if n, err := store.Merge(backfill); n != 2 || err != nil {
+		t.Errorf("Merged %d readings, %v, instead of 2", n, err)
+	}
+	if n, _ := store.Merge(backfill); n != 0 {
+		t.Errorf("Merged %d readings the second time", n)
+	}
+	stored, _ := l.Read(time.Time{}, time.Time{})
+	if len(stored) != 12 || stored[2].Demand != 1.5 || stored[11].Demand != 9.5 {
+		t.Errorf("Got %+v in the backend", stored)
+	}
+	recent := store.Range(start.Add(8*time.Minute), time.Time{})
+	if len(recent) != 3 || recent[1].Demand != 9 || recent[2].Demand != 9.5 {
+		t.Errorf("Got %+v instead of the last three readings", recent)
+	}
+}
@@ -6,60 +6,297 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
-	"os"
-	"strings"
+	"strconv"
 	"time"
 )
 
-func graphiteMetric(name string, value int) {
-	apiKey := os.Getenv("HOSTEDGRAPHITE_APIKEY")
-	if len(apiKey) < 1 {
+func MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		ReceiveMetrics(w, req)
+	} else if req.Method == "GET" {
+		ReportMetrics(w, req)
+	} else {
+		log.Printf("Received bad request: %s %s", req.Method, req.URL)
+		w.WriteHeader(400)
+	}
+}
+
+func ReportMetrics(w http.ResponseWriter, req *http.Request) {
+	key, ok := APIKeys.Authorize(w, req, ReadScope)
+	if !ok {
+		return
+	}
+	query, err := ParseQuery(req.URL.Query())
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Error: %v", err)))
 		return
 	}
-	strTpl := "%s.%s %d\n"
-	datum := fmt.Sprintf(strTpl, apiKey, name, value)
-	conn, _ := net.Dial("udp", "carbon.hostedgraphite.com:2003")
-	defer conn.Close()
-	conn.Write([]byte(datum))
+	query.Allowed = key.Meters
+	readings := query.Filter(Readings.Range(query.From, query.To))
+	var res []byte
+	if len(query.Series) == 0 {
+		page, next := query.Page(readings)
+		if next > 0 {
+			w.Header().Set("X-Next-Offset", strconv.Itoa(next))
+		}
+		res, err = json.Marshal(page)
+	} else {
+		res, err = json.Marshal(query.Run(readings))
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
+	}
+}
+
+// SinksHandler reports how the queued sinks are doing
+func SinksHandler(w http.ResponseWriter, req *http.Request) {
+	res, err := json.Marshal(Sinks.Stats())
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
+	}
 }
 
-func forwardMetric(name string, value int) {
-	url := os.Getenv("INFLUXDB_URL")
-	if len(url) < 1 {
+// CostHandler reports the cost of energy used by each meter in each hour, day
+// or billing period. It takes the same from, to, gateway and meter parameters
+// as GET /metrics, with from defaulting to the start of the current billing
+// period.
+func CostHandler(w http.ResponseWriter, req *http.Request) {
+	key, ok := APIKeys.Authorize(w, req, ReadScope)
+	if !ok {
 		return
 	}
-	jsonTpl := "[{ \"name\": \"%s\", \"columns\": [\"value\"], \"points\": [[%d]] }]"
-	jsonStr := fmt.Sprintf(jsonTpl, name, value)
+	values := req.URL.Query()
+	query, err := ParseQuery(values)
+	period := Daily
+	if v := values.Get("period"); v != "" && err == nil {
+		period, err = ParseCostPeriod(v)
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+		return
+	}
+	if values.Get("from") == "" {
+		query.From = Billing.Start(time.Now())
+	}
+	query.Allowed = key.Meters
+	res, err := json.Marshal(CostReport(period, query.Filter(Readings.Range(query.From, query.To))))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
+	}
+}
 
-	req, _ := http.NewRequest("POST", url, strings.NewReader(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
+// BlocksHandler reports which price block each meter is in
+func BlocksHandler(w http.ResponseWriter, req *http.Request) {
+	key, ok := APIKeys.Authorize(w, req, ReadScope)
+	if !ok {
+		return
+	}
+	blocks := []BlockStatus{}
+	for _, status := range BlockPrices.All() {
+		if key.AllowsMeter(status.Meter) {
+			blocks = append(blocks, status)
+		}
+	}
+	res, err := json.Marshal(blocks)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
+	}
+}
 
-	client := &http.Client{}
-	resp, _ := client.Do(req)
-	defer resp.Body.Close()
+// MessagesHandler lists the utility messages, newest first. They can be
+// filtered by the lowest priority to include and by whether they have been
+// confirmed (Y or N).
+func MessagesHandler(w http.ResponseWriter, req *http.Request) {
+	key, ok := APIKeys.Authorize(w, req, ReadScope)
+	if !ok {
+		return
+	}
+	filter := MessageFilter{
+		Priority:  req.URL.Query().Get("priority"),
+		Confirmed: req.URL.Query().Get("confirmed"),
+	}
+	if filter.Priority != "" && priorityLevel(filter.Priority) < 0 {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Error: unknown priority %q", filter.Priority)))
+		return
+	}
+	messages := []UtilityMessage{}
+	for _, m := range Messages.List(filter) {
+		if key.AllowsMeter(m.Meter) {
+			messages = append(messages, m)
+		}
+	}
+	res, err := json.Marshal(messages)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
+	}
+}
 
-	// fmt.Println("request Body:", jsonStr)
-	// fmt.Println("response Status:", resp.Status)
-	// fmt.Println("response Headers:", resp.Header)
-	// body, _ := ioutil.ReadAll(resp.Body)
-	// fmt.Println("response Body:", string(body))
+// DevicesHandler reports the state of each EAGLE and its recent network
+// status changes
+func DevicesHandler(w http.ResponseWriter, req *http.Request) {
+	key, ok := APIKeys.Authorize(w, req, ReadScope)
+	if !ok {
+		return
+	}
+	devices := []Device{}
+	for _, d := range Devices.List() {
+		if key.AllowsMeter(d.Meter) {
+			devices = append(devices, d)
+		}
+	}
+	res, err := json.Marshal(devices)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
+	}
 }
 
-func MetricsHandler(w http.ResponseWriter, req *http.Request) {
-	if req.Method == "POST" {
-		ReceiveMetrics(w, req)
-	} else if req.Method == "GET" {
-		ReportMetrics(w, req)
+// InventoryHandler lists the EAGLEs that have uploaded since startup and the
+// meters they have reported on
+func InventoryHandler(w http.ResponseWriter, req *http.Request) {
+	res, err := json.Marshal(Gateways.List())
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
 	} else {
-		log.Printf("Received bad request: %s %s", req.Method, req.URL)
-		w.WriteHeader(400)
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(res)
 	}
 }
 
-func ReportMetrics(w http.ResponseWriter, req *http.Request) {
-	res, err := json.Marshal(metrics)
+// FastPollHandler lists the fast poll state of each EAGLE. POST requests fast
+// polling from one, with the parameters read by ParseFastPollRequest, and
+// DELETE stops renewing it.
+func FastPollHandler(w http.ResponseWriter, req *http.Request) {
+	scope := AdminScope
+	if req.Method == "GET" {
+		scope = ReadScope
+	}
+	key, ok := APIKeys.Authorize(w, req, scope)
+	if !ok {
+		return
+	}
+	var res interface{}
+	switch req.Method {
+	case "GET":
+		states := []FastPollState{}
+		for _, s := range FastPolls.List() {
+			if key.AllowsMeter(s.Meter) {
+				states = append(states, s)
+			}
+		}
+		res = states
+	case "POST":
+		gateway, r, err := ParseFastPollRequest(req.URL.Query(), time.Now())
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+			return
+		}
+		state, err := FastPolls.Request(gateway, r)
+		if err == ErrNoCommander {
+			w.WriteHeader(404)
+			w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+			return
+		} else if err != nil {
+			w.WriteHeader(502)
+			w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+			return
+		}
+		res = state
+	case "DELETE":
+		gateway, err := ParseMacAddr(req.URL.Query().Get("gateway"))
+		if err != nil || gateway == "" {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Error: gateway %q isn't a MAC address", req.URL.Query().Get("gateway"))))
+			return
+		}
+		FastPolls.Cancel(gateway)
+		res = FastPolls.Get(gateway)
+	default:
+		w.WriteHeader(405)
+		return
+	}
+	buf, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
+	} else {
+		w.Header().Set(http.CanonicalHeaderKey("content-type"), "application/json")
+		w.Write(buf)
+	}
+}
+
+// BackfillHandler reports what happened to each gap the last time history was
+// fetched to fill them. POST starts looking for gaps between from, which
+// defaults to BackfillLookback ago, and to, and filling them, and responds
+// straight away; GET gives the results once it is done.
+func BackfillHandler(w http.ResponseWriter, req *http.Request) {
+	scope := AdminScope
+	if req.Method == "GET" {
+		scope = ReadScope
+	}
+	key, ok := APIKeys.Authorize(w, req, scope)
+	if !ok {
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		query, err := ParseQuery(req.URL.Query())
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Error: %v", err)))
+			return
+		}
+		if req.URL.Query().Get("from") == "" {
+			query.From = time.Now().Add(-BackfillLookback)
+		}
+		if !Backfills.Start(Readings, query.From, query.To) {
+			w.WriteHeader(409)
+			w.Write([]byte("Error: a backfill is already running"))
+			return
+		}
+		w.WriteHeader(202)
+		return
+	default:
+		w.WriteHeader(405)
+		return
+	}
+	allowed := []BackfillResult{}
+	for _, r := range Backfills.Last() {
+		if key.AllowsMeter(r.Meter) {
+			allowed = append(allowed, r)
+		}
+	}
+	res, err := json.Marshal(allowed)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(fmt.Sprintf("Error: %+v", err)))
@@ -70,12 +307,45 @@ func ReportMetrics(w http.ResponseWriter, req *http.Request) {
 }
 
 type Reading struct {
-	Time   time.Time `json:"time"`
-	Demand int       `json:"demand"`
-	Price  int       `json:"price"`
+	Time      time.Time `json:"time"`
+	Gateway   string    `json:"gateway,omitempty"`
+	Meter     string    `json:"meter,omitempty"`
+	Demand    Power     `json:"demand"`
+	Price     Price     `json:"price"`
+	Tier      int       `json:"tier,omitempty"`
+	Rate      string    `json:"rate,omitempty"`
+	Delivered Energy    `json:"delivered"`
+	Received  Energy    `json:"received"`
+	// Fragment is the kind of fragment the reading came from. Only the values
+	// it carries are new, the rest are carried forward from earlier readings
+	// of the meter. Readings stored before it was recorded leave it empty.
+	Fragment string `json:"fragment,omitempty"`
 }
 
-var metrics = make([]Reading, 1)
+// The series each kind of fragment gives new values for. PriceCluster sets
+// the tier and rate along with the price.
+var fragmentSeries = map[string][]string{
+	"InstantaneousDemand": {"demand"},
+	"PriceCluster":        {"price"},
+	"CurrentSummation":    {"delivered", "received"},
+	"HistoryData":         {"delivered", "received"},
+	"ProfileData":         {"demand", "delivered"},
+}
+
+// Sets reports whether the reading gives a new value for a series rather than
+// carrying one forward. Readings that don't say what fragment they came from
+// are taken to set them all.
+func (r Reading) Sets(series string) bool {
+	if r.Fragment == "" {
+		return true
+	}
+	for _, s := range fragmentSeries[r.Fragment] {
+		if s == series {
+			return true
+		}
+	}
+	return false
+}
 
 func ReceiveMetrics(w http.ResponseWriter, req *http.Request) {
 	msg := Request{}
@@ -91,12 +361,38 @@ func ReceiveMetrics(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte(err.Error()))
 		log.Printf("500 from %+v: %s\n", req, err)
 	} else {
+		if err := Uploads.Check(req, msg, body); err != nil {
+			Uploads.Refuse(w, req, msg, body, err)
+			return
+		}
 		reqType := msg.Fragment.XMLName.Local
+		Prometheus.Inc("eagle_fragments_total", "gateway", msg.MacId.String(), "type", reqType)
+		Gateways.Record(msg, time.Now())
+		if err := msg.Fragment.badMac; err != nil {
+			log.Printf("Skipping %s from %s: %v", reqType, msg.MacId, err)
+			return
+		}
 		switch reqType {
 		case "InstantaneousDemand":
 			ReceiveDemand(w, req, body)
 		case "PriceCluster":
 			ReceivePrice(w, req, body)
+		case "CurrentSummation":
+			ReceiveSummation(w, req, body)
+		case "NetworkInfo":
+			ReceiveNetworkInfo(w, req, body)
+		case "DeviceInfo":
+			ReceiveDeviceInfo(w, req, body)
+		case "BlockPriceDetail":
+			ReceiveBlockPriceDetail(w, req, body)
+		case "Message", "MessageCluster":
+			ReceiveMessage(w, req, body)
+		case "FastPollStatus":
+			ReceiveFastPollStatus(w, req, body)
+		case "HistoryData":
+			ReceiveHistoryData(w, req, body)
+		case "ProfileData":
+			ReceiveProfileData(w, req, body)
 		default:
 			w.WriteHeader(200)
 			log.Printf("%s", reqType)
@@ -112,11 +408,23 @@ func ReceiveDemand(w http.ResponseWriter, req *http.Request, body []byte) {
 		w.WriteHeader(500)
 		log.Printf("500 from %+v: %v", req, err)
 	} else {
-		result := Reading{time.Now(), demand.Int(), metrics[len(metrics)-1].Price}
+		d := demand.InstantaneousDemand
+		result, err := Readings.Update(meterKey(demand.MacId, d.MeterMacId), func(r Reading) Reading {
+			r.Time = demand.Time()
+			r.Demand = demand.Power()
+			r.Fragment = "InstantaneousDemand"
+			return r
+		})
+		if err != nil {
+			w.WriteHeader(500)
+			log.Printf("500 from %+v: %v", req, err)
+			return
+		}
 		log.Printf("InstantaneousDemand: %+v", result)
-		forwardMetric("demand", demand.Int())
-		graphiteMetric("demand", demand.Int())
-		// metrics = append(metrics, result)
+		tags := meterTags(demand.MacId, d.DeviceMacId, d.MeterMacId)
+		Prometheus.Set("eagle_demand_watts", result.Demand.Watts(), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Sinks.Dispatch(Metric{"demand", float64(result.Demand), result.Time, tags})
+		recordCost(result, tags)
 	}
 }
 
@@ -127,10 +435,249 @@ func ReceivePrice(w http.ResponseWriter, req *http.Request, body []byte) {
 		w.WriteHeader(500)
 		log.Printf("500 from %+v: %v", req, err)
 	} else {
-		result := Reading{time.Now(), metrics[len(metrics)-1].Demand, price.Int()}
+		p := price.PriceCluster
+		result, err := Readings.Update(meterKey(price.MacId, p.MeterMacId), func(r Reading) Reading {
+			r.Time = price.Time()
+			r.Price = price.Price()
+			r.Tier = int(p.Tier)
+			r.Rate = p.RateLabel
+			r.Fragment = "PriceCluster"
+			return r
+		})
+		if err != nil {
+			w.WriteHeader(500)
+			log.Printf("500 from %+v: %v", req, err)
+			return
+		}
 		log.Printf("PriceCluster: %+v", result)
-		forwardMetric("price", price.Int())
-		graphiteMetric("price", price.Int())
-		// metrics = append(metrics, result)
+		tags := meterTags(price.MacId, p.DeviceMacId, p.MeterMacId)
+		tags["rate"] = p.RateLabel
+		tags["currency"] = result.Price.CurrencyCode()
+		Prometheus.Set("eagle_price", result.Price.Float(), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"], "currency", tags["currency"])
+		Prometheus.Set("eagle_price_tier", float64(p.Tier), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Sinks.Dispatch(Metric{"price", result.Price.Float(), result.Time, tags})
+		recordCost(result, tags)
+	}
+}
+
+func ReceiveSummation(w http.ResponseWriter, req *http.Request, body []byte) {
+	summation := CurrentSummation{}
+	err := xml.Unmarshal(body, &summation)
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+	} else {
+		c := summation.CurrentSummation
+		result, err := Readings.Update(meterKey(summation.MacId, c.MeterMacId), func(r Reading) Reading {
+			r.Time = summation.Time()
+			r.Delivered = summation.Delivered()
+			r.Received = summation.Received()
+			r.Fragment = "CurrentSummation"
+			return r
+		})
+		if err != nil {
+			w.WriteHeader(500)
+			log.Printf("500 from %+v: %v", req, err)
+			return
+		}
+		log.Printf("CurrentSummation: %+v", result)
+		if err := Backfills.SetScale(result.Key(), c.Multiplier, c.Divisor); err != nil {
+			log.Printf("Saving the scale of %s: %v", result.Meter, err)
+		}
+		tags := meterTags(summation.MacId, c.DeviceMacId, c.MeterMacId)
+		Prometheus.Set("eagle_summation_delivered_kwh", float64(result.Delivered), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Prometheus.Set("eagle_summation_received_kwh", float64(result.Received), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Sinks.Dispatch(
+			Metric{"delivered", float64(result.Delivered), result.Time, tags},
+			Metric{"received", float64(result.Received), result.Time, tags},
+		)
+		recordCost(result, tags)
+	}
+}
+
+// ReceiveProfileData stores the intervals of a meter's profile data as
+// readings, skipping any already stored. They can't be used until a summation
+// has told how to scale them and given a starting point.
+func ReceiveProfileData(w http.ResponseWriter, req *http.Request, body []byte) {
+	profile := ProfileData{}
+	if err := xml.Unmarshal(body, &profile); err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
+	}
+	readings, err := Backfills.ProfileReadings(Readings, profile.MacId.String(), profile.ProfileData)
+	if err != nil {
+		log.Printf("Skipping ProfileData from %s: %v", profile.MacId, err)
+		return
+	}
+	added, err := Readings.Merge(readings)
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
+	}
+	log.Printf("ProfileData: %d of %d intervals added", added, len(readings))
+}
+
+// ReceiveHistoryData stores a batch of past summations all at once, skipping
+// any already stored. The history says nothing of the demand or price at the
+// time, so the readings only have the summation.
+func ReceiveHistoryData(w http.ResponseWriter, req *http.Request, body []byte) {
+	history := HistoryData{}
+	if err := xml.Unmarshal(body, &history); err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
+	}
+	readings := []Reading{}
+	for _, c := range history.HistoryData.CurrentSummation {
+		summation := CurrentSummation{CurrentSummation: c}
+		readings = append(readings, historyReading(meterKey(history.MacId, c.MeterMacId), summation))
+	}
+	added, err := Readings.Merge(readings)
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
+	}
+	log.Printf("HistoryData: %d of %d summations from %s were new", added, len(readings), history.MacId)
+}
+
+func meterKey(gateway, meter MacAddrHex) MeterKey {
+	return MeterKey{gateway.String(), meter.String()}
+}
+
+// A reading of a meter's summation from its history, which has nothing else
+func historyReading(key MeterKey, s CurrentSummation) Reading {
+	return Reading{
+		Time:      s.Time(),
+		Gateway:   key.Gateway,
+		Meter:     key.Meter,
+		Delivered: s.Delivered(),
+		Received:  s.Received(),
+		Fragment:  "HistoryData",
+	}
+}
+
+// Add a reading to the running costs and pass them on once the price is known
+func recordCost(r Reading, tags map[string]string) {
+	metrics := []Metric{}
+	for _, cost := range Costs.Add(r) {
+		if cost.Cost.Currency == 0 {
+			continue
+		}
+		currency := cost.Cost.CurrencyCode()
+		Prometheus.Set("eagle_cost", cost.Cost.Float(), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"], "period", string(cost.Period), "currency", currency)
+		costTags := map[string]string{"gateway": tags["gateway"], "device": tags["device"], "meter": tags["meter"], "currency": currency}
+		metrics = append(metrics, Metric{"cost_" + string(cost.Period), cost.Cost.Float(), r.Time, costTags})
+	}
+	if len(metrics) > 0 {
+		Sinks.Dispatch(metrics...)
+	}
+}
+
+func ReceiveBlockPriceDetail(w http.ResponseWriter, req *http.Request, body []byte) {
+	detail := BlockPriceDetail{}
+	err := xml.Unmarshal(body, &detail)
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+	} else {
+		status := detail.Status()
+		log.Printf("BlockPriceDetail: block %d at %s, %s used, %s remaining", status.Block, status.Price, status.Consumption, status.Remaining)
+		b := detail.BlockPriceDetail
+		tags := meterTags(detail.MacId, b.DeviceMacId, b.MeterMacId)
+		status.Gateway, status.Meter = tags["gateway"], tags["meter"]
+		BlockPrices.Set(meterKey(detail.MacId, b.MeterMacId), status)
+		Prometheus.Set("eagle_block", float64(status.Block), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Prometheus.Set("eagle_block_consumption_kwh", float64(status.Consumption), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Prometheus.Set("eagle_block_remaining_kwh", float64(status.Remaining), "gateway", tags["gateway"], "device", tags["device"], "meter", tags["meter"])
+		Sinks.Dispatch(
+			Metric{"block", float64(status.Block), status.Time, tags},
+			Metric{"block_consumption", float64(status.Consumption), status.Time, tags},
+			Metric{"block_remaining", float64(status.Remaining), status.Time, tags},
+		)
+	}
+}
+
+func ReceiveMessage(w http.ResponseWriter, req *http.Request, body []byte) {
+	// Message and MessageCluster fragments are the same apart from the name
+	doc := struct {
+		RainforestDocument
+		Message MessageFragment `xml:",any"`
+	}{}
+	err := xml.Unmarshal(body, &doc)
+	if err == nil {
+		var added bool
+		msg := NewUtilityMessage(doc.Message, time.Now())
+		if added, err = Messages.Add(msg); added {
+			log.Printf("Message %d (%s priority): %s", msg.Id, msg.Priority, msg.Text)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+	}
+}
+
+func ReceiveNetworkInfo(w http.ResponseWriter, req *http.Request, body []byte) {
+	info := NetworkInfo{}
+	err := xml.Unmarshal(body, &info)
+	var change *StatusChange
+	if err == nil {
+		change, err = Devices.UpdateNetwork(info.NetworkInfo, time.Now())
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
+	}
+	n := info.NetworkInfo
+	log.Printf("NetworkInfo: %s %s link strength %d", n.DeviceMacId, n.Status, n.LinkStrength)
+	if change != nil {
+		log.Printf("%s is now %s: %s", n.DeviceMacId, change.Status, change.Description)
+		Prometheus.Inc("eagle_status_changes_total", "gateway", info.MacId.String(), "device", n.DeviceMacId.String(), "status", change.Status)
+	}
+	Prometheus.Set("eagle_link_strength", float64(n.LinkStrength), "gateway", info.MacId.String(), "device", n.DeviceMacId.String(), "meter", n.CoordMacId.String())
+	connected := 0.0
+	if n.Status == "Connected" {
+		connected = 1
+	}
+	Prometheus.Set("eagle_connected", connected, "gateway", info.MacId.String(), "device", n.DeviceMacId.String())
+	tags := meterTags(info.MacId, n.DeviceMacId, n.CoordMacId)
+	Sinks.Dispatch(
+		Metric{"link_strength", float64(n.LinkStrength), time.Now(), tags},
+		Metric{"connected", connected, time.Now(), tags},
+	)
+}
+
+func ReceiveDeviceInfo(w http.ResponseWriter, req *http.Request, body []byte) {
+	info := DeviceInfo{}
+	err := xml.Unmarshal(body, &info)
+	if err == nil {
+		err = Devices.UpdateInfo(info.DeviceInfo, time.Now())
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
+	}
+	d := info.DeviceInfo
+	log.Printf("DeviceInfo: %s %s firmware %s hardware %s", d.DeviceMacId, d.ModelId, d.FWVersion, d.HWVersion)
+	// Drop the versions it had before, so only the current ones are exported
+	Prometheus.Delete("eagle_device_info", "device", d.DeviceMacId.String())
+	Prometheus.Set("eagle_device_info", 1, "device", d.DeviceMacId.String(), "model", d.ModelId, "fw_version", d.FWVersion, "hw_version", d.HWVersion)
+}
+
+func ReceiveFastPollStatus(w http.ResponseWriter, req *http.Request, body []byte) {
+	status := FastPollStatus{}
+	if err := xml.Unmarshal(body, &status); err != nil {
+		w.WriteHeader(500)
+		log.Printf("500 from %+v: %v", req, err)
+		return
 	}
+	f := status.FastPollStatus
+	FastPolls.Update(status.MacId.String(), f, time.Now())
+	log.Printf("FastPollStatus: %s polling every %v until %s", f.DeviceMacId, f.Interval(), f.EndTime)
+	Prometheus.Set("eagle_fast_poll_end_time_seconds", float64(f.EndTime.Time().Unix()), "gateway", status.MacId.String(), "meter", f.MeterMacId.String())
 }
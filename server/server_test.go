@@ -1,13 +1,14 @@
 package server
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestInstantaneousDemandRequest(t *testing.T) {
@@ -40,6 +41,10 @@ func TestInstantaneousDemandRequest(t *testing.T) {
 }
 
 func TestGetMetrics(t *testing.T) {
+	saved := Readings
+	defer func() { Readings = saved }()
+	Readings = NewMemoryStore(10)
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "InstantaneousDemand"))
 	record := httptest.NewRecorder()
 	req := &http.Request{
 		Method: "GET",
@@ -49,10 +54,155 @@ func TestGetMetrics(t *testing.T) {
 	if record.Code != 200 {
 		t.Errorf("Response was %d not 200", record.Code)
 	}
-	body, err := ioutil.ReadAll(record.Body)
+	readings := []Reading{}
+	if err := json.Unmarshal(record.Body.Bytes(), &readings); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(readings) != 1 || readings[0].Demand != 5.944 {
+		t.Errorf("Got %s instead of the one demand reading", record.Body)
+	}
+}
+
+func TestGetBlocks(t *testing.T) {
+	saved := BlockPrices
+	defer func() { BlockPrices = saved }()
+	BlockPrices = &BlockPriceTracker{}
+	postFragment(t, blockPriceDetail)
+	// The same meter seen through another gateway is kept apart
+	postFragment(t, strings.Replace(blockPriceDetail, "0xf0ad4e00ce69", "0xf0ad4e00ce70", 1))
+	record := httptest.NewRecorder()
+	BlocksHandler(record, &http.Request{Method: "GET", URL: &url.URL{Path: "/blocks"}})
+	statuses := []BlockStatus{}
+	if err := json.Unmarshal(record.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(statuses) != 2 || statuses[0].Gateway != "f0:ad:4e:00:ce:69" || statuses[1].Gateway != "f0:ad:4e:00:ce:70" {
+		t.Fatalf("Got %s instead of one status from each gateway", record.Body)
+	}
+	status := statuses[0]
+	if status.Meter != "00:07:81:00:00:7d:67:bb" || status.Block != 2 || len(status.Blocks) != 3 || status.PeriodEnd == nil {
+		t.Errorf("Got %s", record.Body)
+	}
+}
+
+func TestBadMacSkipped(t *testing.T) {
+	saved := Readings
+	defer func() { Readings = saved }()
+	Readings = NewMemoryStore(10)
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x0017zz0000000004", "InstantaneousDemand"))
+	if readings := Readings.Range(time.Time{}, time.Time{}); len(readings) != 0 {
+		t.Errorf("Got %+v from a fragment with a bad meter", readings)
+	}
+}
+
+func TestHistoryDataRequest(t *testing.T) {
+	const body = `<rainforest macId="0xf0ad4e00ce69">
+  <HistoryData>
+    <CurrentSummation>
+      <MeterMacId>0x00178d0000000004</MeterMacId>
+      <TimeStamp>0x185ad8a0</TimeStamp>
+      <SummationDelivered>0x0000000001321a5f</SummationDelivered>
+      <Divisor>0x000003e8</Divisor>
+    </CurrentSummation>
+    <CurrentSummation>
+      <MeterMacId>0x00178d0000000004</MeterMacId>
+      <TimeStamp>0x185ad51c</TimeStamp>
+      <SummationDelivered>0x0000000001321000</SummationDelivered>
+      <Divisor>0x000003e8</Divisor>
+    </CurrentSummation>
+    <CurrentSummation>
+      <MeterMacId>0x00178d0000000004</MeterMacId>
+      <TimeStamp>0x185ad198</TimeStamp>
+      <SummationDelivered>0x0000000001320a00</SummationDelivered>
+      <Divisor>0x000003e8</Divisor>
+    </CurrentSummation>
+  </HistoryData>
+  </rainforest>`
+	savedReadings := Readings
+	defer func() { Readings = savedReadings }()
+	Readings = NewMemoryStore(10)
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "InstantaneousDemand"))
+	postFragment(t, body)
+	postFragment(t, body)
+
+	readings := Readings.Range(time.Time{}, time.Time{})
+	if len(readings) != 4 {
+		t.Fatalf("Got %d readings instead of 4: %+v", len(readings), readings)
+	}
+	expected := []Energy{20056.576, 20058.112, 20060.767}
+	for i, r := range readings[:3] {
+		// The demand and price at the time aren't known
+		if r.Delivered != expected[i] || r.Demand != 0 || !r.Price.Money.IsZero() || r.Fragment != "HistoryData" || r.Meter != "00:17:8d:00:00:00:00:04" {
+			t.Errorf("Reading %d is %+v", i, r)
+		}
+	}
+	if readings[3].Delivered != 0 {
+		t.Errorf("Expected the demand reading last, got %+v", readings[3])
+	}
+}
 
-	matched, err := regexp.Match("\"demand\":\\d", body)
-	if err != nil || !matched {
-		t.Errorf("Failed match in: '%s' (%v)", body, err)
+func gatewayFragment(gateway, meter, fragment string) string {
+	return `<rainforest macId="` + gateway + `">
+  <` + fragment + `>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <MeterMacId>` + meter + `</MeterMacId>
+    <TimeStamp>0x185adc1d</TimeStamp>
+    <Demand>0x001738</Demand>
+    <Price>0x0000031d</Price>
+    <Currency>0x007c</Currency>
+    <TrailingDigits>0x04</TrailingDigits>
+    <Multiplier>0x00000001</Multiplier>
+    <Divisor>0x000003e8</Divisor>
+  </` + fragment + `>
+  </rainforest>`
+}
+
+func TestMultipleMeters(t *testing.T) {
+	savedReadings, savedGateways := Readings, Gateways
+	defer func() { Readings, Gateways = savedReadings, savedGateways }()
+	Readings, Gateways = NewMemoryStore(10), &Inventory{}
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "PriceCluster"))
+	postFragment(t, gatewayFragment("0xf0ad4e00ce70", "0x00178d0000000005", "InstantaneousDemand"))
+	postFragment(t, gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "InstantaneousDemand"))
+
+	first, _ := Readings.Latest(MeterKey{"f0:ad:4e:00:ce:69", "00:17:8d:00:00:00:00:04"})
+	second, _ := Readings.Latest(MeterKey{"f0:ad:4e:00:ce:70", "00:17:8d:00:00:00:00:05"})
+	if first.Price.IsZero() || first.Demand != 5.944 {
+		t.Errorf("First meter didn't keep its own price: %+v", first)
+	}
+	if !second.Price.IsZero() || second.Demand != 5.944 {
+		t.Errorf("Second meter got another meter's price: %+v", second)
+	}
+
+	record := httptest.NewRecorder()
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/metrics", RawQuery: "series=demand"}}
+	MetricsHandler(record, req)
+	result := QueryResult{}
+	if err := json.Unmarshal(record.Body.Bytes(), &result); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(result.Series) != 2 || result.Series[0].Meter != "00:17:8d:00:00:00:00:04" || result.Series[1].Gateway != "f0:ad:4e:00:ce:70" {
+		t.Errorf("Expected a series for each meter, got %s", record.Body)
+	}
+
+	record = httptest.NewRecorder()
+	req.URL.RawQuery = "meter=0x00178d0000000005"
+	MetricsHandler(record, req)
+	readings := []Reading{}
+	if err := json.Unmarshal(record.Body.Bytes(), &readings); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(readings) != 1 || readings[0].Gateway != "f0:ad:4e:00:ce:70" {
+		t.Errorf("Expected just the second meter's reading, got %s", record.Body)
+	}
+
+	record = httptest.NewRecorder()
+	InventoryHandler(record, &http.Request{Method: "GET", URL: &url.URL{Path: "/inventory"}})
+	gateways := []Gateway{}
+	if err := json.Unmarshal(record.Body.Bytes(), &gateways); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(gateways) != 2 || gateways[0].Fragments["InstantaneousDemand"] != 1 || len(gateways[0].Meters) != 1 || gateways[1].Meters[0].MacId != "00:17:8d:00:00:00:00:05" {
+		t.Errorf("Got inventory %s", record.Body)
 	}
 }
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Metric is a single named value taken from a reading
+type Metric struct {
+	Name  string
+	Value float64
+	Time  time.Time
+	Tags  map[string]string
+}
+
+// Tags identifying the EAGLE and meter a metric came from. The gateway is the
+// MacId of the upload and the device is the MAC address of its ZigBee radio.
+func meterTags(gateway, device, meter MacAddrHex) map[string]string {
+	return map[string]string{"gateway": gateway.String(), "device": device.String(), "meter": meter.String()}
+}
+
+var templateField = regexp.MustCompile(`{[^{}]+}`)
+
+// Replace {name} in a template with the metric's name and any other {field}
+// with the value of that tag, or "unknown" if it isn't set. Values are passed
+// through clean first.
+func fillTemplate(template string, m Metric, clean func(string) string) string {
+	return templateField.ReplaceAllStringFunc(template, func(field string) string {
+		field = field[1 : len(field)-1]
+		value := m.Tags[field]
+		if field == "name" {
+			value = m.Name
+		}
+		if value == "" {
+			value = "unknown"
+		}
+		return clean(value)
+	})
+}
+
+// A Sink forwards metrics to another system
+type Sink interface {
+	Send(metrics []Metric) error
+}
+
+// SinkConfig holds the settings for one sink, keyed by lower case name
+type SinkConfig map[string]string
+
+// A SinkFactory creates a sink of one kind from its configuration
+type SinkFactory func(config SinkConfig) (Sink, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]SinkFactory{}
+)
+
+// RegisterSink makes a kind of sink available to NewSink and ConfigureSinks
+func RegisterSink(kind string, factory SinkFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[kind] = factory
+}
+
+func NewSink(kind string, config SinkConfig) (Sink, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[kind]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q", kind)
+	}
+	return factory(config)
+}
+
+// A Dispatcher fans each batch of metrics out to every sink it holds
+type Dispatcher struct {
+	mu    sync.RWMutex
+	sinks map[string]Sink
+}
+
+// Sinks is the dispatcher used by the HTTP handlers
+var Sinks = &Dispatcher{}
+
+func (d *Dispatcher) Add(name string, sink Sink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sinks == nil {
+		d.sinks = make(map[string]Sink)
+	}
+	d.sinks[name] = sink
+}
+
+// Remove takes a sink out of the dispatcher, closing it if it needs to be
+func (d *Dispatcher) Remove(name string) {
+	d.mu.Lock()
+	sink := d.sinks[name]
+	delete(d.sinks, name)
+	d.mu.Unlock()
+	if closer, ok := sink.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Stats reports the queue statistics of each queued sink
+func (d *Dispatcher) Stats() map[string]QueueStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	stats := make(map[string]QueueStats)
+	for name, sink := range d.sinks {
+		if q, ok := sink.(*QueuedSink); ok {
+			stats[name] = q.Stats()
+		}
+	}
+	return stats
+}
+
+// Names lists the sinks in the dispatcher
+func (d *Dispatcher) Names() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	names := []string{}
+	for name := range d.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dispatch sends the metrics from one reading to every sink. Failures are
+// logged rather than returned so one broken sink doesn't affect the others.
+// Sinks added by ConfigureSinks are queued, so this doesn't wait for them.
+func (d *Dispatcher) Dispatch(metrics ...Metric) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for name, sink := range d.sinks {
+		if err := sink.Send(metrics); err != nil {
+			log.Printf("Sink %s: %v", name, err)
+		}
+	}
+}
+
+// EnvironMap turns KEY=value pairs, as returned by os.Environ, into a map
+func EnvironMap(environ []string) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
+
+// ConfigureSinks adds the sinks described by environment variables, given in
+// the form returned by os.Environ, to the dispatcher.
+//
+// SINKS is a comma separated list of sinks, each either a kind or name:kind.
+// The settings for each sink are read from SINK_<NAME>_<SETTING> variables,
+// so SINKS=home:graphite reads SINK_HOME_HOST and so on.
+//
+// For compatibility INFLUXDB_URL and HOSTEDGRAPHITE_APIKEY each add a sink
+// when set.
+//
+// Every sink is wrapped in a QueuedSink configured by its queue_size, retries,
+// backoff, max_backoff, spill_dir and spill_limit settings. When DATA_DIR is
+// set spill_dir defaults to DATA_DIR/spill/<name>.
+func (d *Dispatcher) ConfigureSinks(environ []string) error {
+	env := EnvironMap(environ)
+	configs := make(map[string]SinkConfig)
+	kinds := make(map[string]string)
+	if url := env["INFLUXDB_URL"]; url != "" {
+		kinds["influxdb"] = "influxdb08"
+		configs["influxdb"] = SinkConfig{"url": url}
+	}
+	if key := env["HOSTEDGRAPHITE_APIKEY"]; key != "" {
+		kinds["hostedgraphite"] = "hostedgraphite"
+		configs["hostedgraphite"] = SinkConfig{"apikey": key}
+	}
+	for _, entry := range strings.Split(env["SINKS"], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, kind := entry, entry
+		if i := strings.Index(entry, ":"); i >= 0 {
+			name, kind = entry[:i], entry[i+1:]
+		}
+		config := SinkConfig{}
+		prefix := "SINK_" + strings.ToUpper(name) + "_"
+		for k, v := range env {
+			if strings.HasPrefix(k, prefix) {
+				config[strings.ToLower(k[len(prefix):])] = v
+			}
+		}
+		kinds[name] = kind
+		configs[name] = config
+	}
+	for name, kind := range kinds {
+		sink, err := NewSink(kind, configs[name])
+		if err != nil {
+			return fmt.Errorf("sink %s: %v", name, err)
+		}
+		opts := DefaultQueueOptions
+		if dir := env["DATA_DIR"]; dir != "" {
+			opts.SpillDir = filepath.Join(dir, "spill", name)
+		}
+		if opts, err = queueOptions(configs[name], opts); err != nil {
+			return fmt.Errorf("sink %s: %v", name, err)
+		}
+		d.Add(name, NewQueuedSink(sink, opts))
+	}
+	return nil
+}
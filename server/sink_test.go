@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Sink that remembers what it was sent
+type recordingSink struct {
+	config SinkConfig
+	sent   []Metric
+	err    error
+}
+
+func (s *recordingSink) Send(metrics []Metric) error {
+	s.sent = append(s.sent, metrics...)
+	return s.err
+}
+
+func TestDispatcherFanOut(t *testing.T) {
+	d := &Dispatcher{}
+	good := &recordingSink{}
+	bad := &recordingSink{err: errors.New("unreachable")}
+	d.Add("good", good)
+	d.Add("bad", bad)
+	m := Metric{Name: "demand", Value: 1.5, Time: time.Now()}
+	d.Dispatch(m)
+	if len(good.sent) != 1 || len(bad.sent) != 1 {
+		t.Errorf("Expected each sink to get the metric: %+v %+v", good.sent, bad.sent)
+	}
+	d.Remove("bad")
+	d.Dispatch(m)
+	if len(good.sent) != 2 || len(bad.sent) != 1 {
+		t.Errorf("Removed sink still got metrics: %+v %+v", good.sent, bad.sent)
+	}
+}
+
+func TestConfigureSinks(t *testing.T) {
+	sinks := []*recordingSink{}
+	RegisterSink("recording", func(config SinkConfig) (Sink, error) {
+		s := &recordingSink{config: config}
+		sinks = append(sinks, s)
+		return s, nil
+	})
+	d := &Dispatcher{}
+	err := d.ConfigureSinks([]string{
+		"SINKS=recording, home:recording",
+		"SINK_HOME_HOST=carbon.local",
+		"SINK_HOME_PREFIX=home",
+		"INFLUXDB_URL=http://localhost:8086/db/eagle/series",
+	})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	names := d.Names()
+	if !reflect.DeepEqual(names, []string{"home", "influxdb", "recording"}) {
+		t.Errorf("Got sinks %v", names)
+	}
+	var home SinkConfig
+	for _, s := range sinks {
+		if s.config["host"] != "" {
+			home = s.config
+		}
+	}
+	if !reflect.DeepEqual(home, SinkConfig{"host": "carbon.local", "prefix": "home"}) {
+		t.Errorf("Got config %v", home)
+	}
+	if err := d.ConfigureSinks([]string{"SINKS=nonesuch"}); err == nil {
+		t.Errorf("Expected an error for an unknown sink")
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultCapacity = 4096
+
+// A Store keeps the readings received from the EAGLE
+type Store interface {
+	// Append records a new reading
+	Append(r Reading) error
+	// Latest returns the newest reading from a meter by time, if there is
+	// one, with each series carried forward from the newest reading that
+	// sets it. Readings uploaded late or that only set some series, like
+	// merged history, don't hide the meter's current values.
+	Latest(key MeterKey) (Reading, bool)
+	// Update appends the reading made by update from the latest one of a
+	// meter, or from an empty reading with its key if there isn't one. Both
+	// happen in one step, so concurrent updates to different values of the
+	// same meter don't lose each other's changes.
+	Update(key MeterKey, update func(Reading) Reading) (Reading, error)
+	// Range returns the readings with from <= Time < to, oldest first. A zero
+	// to means there is no upper bound.
+	//
+	// Readings are timed by the meter, so delayed uploads may be appended
+	// after newer readings; Range still returns them in time order.
+	Range(from, to time.Time) []Reading
+	// Merge adds readings from the past, such as history fetched from the
+	// EAGLE, skipping any already stored for the same meter and time that
+	// also have the summation, or also lack it. The new readings are added
+	// together, so if it fails none of them are. Returns how many were added.
+	Merge(readings []Reading) (int, error)
+}
+
+// A MeterKey identifies the readings from one meter through one EAGLE: the
+// MacId of the upload and the MeterMacId of the fragment
+type MeterKey struct {
+	Gateway string
+	Meter   string
+}
+
+func (r Reading) Key() MeterKey {
+	return MeterKey{r.Gateway, r.Meter}
+}
+
+// Identifies a reading for Merge. A reading with the summation and one
+// without it at the same time, such as history and demand, are both kept.
+type readingKey struct {
+	MeterKey
+	Time      int64
+	Summation bool
+}
+
+func (r Reading) mergeKey() readingKey {
+	return readingKey{r.Key(), r.Time.UnixNano(), r.Sets("delivered")}
+}
+
+// The readings not already in stored, or earlier in readings
+func newReadings(stored, readings []Reading) []Reading {
+	seen := make(map[readingKey]bool, len(stored))
+	for _, r := range stored {
+		seen[r.mergeKey()] = true
+	}
+	added := []Reading{}
+	for _, r := range readings {
+		if !seen[r.mergeKey()] {
+			seen[r.mergeKey()] = true
+			added = append(added, r)
+		}
+	}
+	return added
+}
+
+// Split readings up by meter, keeping them in the same order. The keys are
+// sorted.
+func partition(readings []Reading) ([]MeterKey, map[MeterKey][]Reading) {
+	keys := []MeterKey{}
+	parts := make(map[MeterKey][]Reading)
+	for _, r := range readings {
+		key := r.Key()
+		if _, ok := parts[key]; !ok {
+			keys = append(keys, key)
+		}
+		parts[key] = append(parts[key], r)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Gateway != keys[j].Gateway {
+			return keys[i].Gateway < keys[j].Gateway
+		}
+		return keys[i].Meter < keys[j].Meter
+	})
+	return keys, parts
+}
+
+// Readings is the store used by the HTTP handlers
+var Readings Store = NewMemoryStore(DefaultCapacity)
+
+// MemoryStore is a fixed size ring buffer of readings. Once it is full the
+// oldest readings are overwritten.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	buf   []Reading
+	start int
+	count int
+}
+
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity < 1 {
+		capacity = DefaultCapacity
+	}
+	return &MemoryStore{buf: make([]Reading, capacity)}
+}
+
+func (s *MemoryStore) Append(r Reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.append(r)
+	return nil
+}
+
+// Callers must hold the lock
+func (s *MemoryStore) append(r Reading) {
+	end := (s.start + s.count) % len(s.buf)
+	s.buf[end] = r
+	if s.count < len(s.buf) {
+		s.count++
+	} else {
+		s.start = (s.start + 1) % len(s.buf)
+	}
+}
+
+func (s *MemoryStore) Latest(key MeterKey) (Reading, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latest(key)
+}
+
+// Callers must hold the lock
+func (s *MemoryStore) latest(key MeterKey) (Reading, bool) {
+	var latest, demand, price, summation *Reading
+	for i := 0; i < s.count; i++ {
+		r := s.at(i)
+		if r.Key() != key {
+			continue
+		}
+		// Of readings at the same time the last appended wins
+		newest := func(found **Reading, sets bool) {
+			if sets && (*found == nil || !r.Time.Before((*found).Time)) {
+				*found = &r
+			}
+		}
+		newest(&latest, true)
+		newest(&demand, r.Sets("demand"))
+		newest(&price, r.Sets("price"))
+		newest(&summation, r.Sets("delivered"))
+	}
+	if latest == nil {
+		return Reading{}, false
+	}
+	result := *latest
+	if demand != nil {
+		result.Demand = demand.Demand
+	}
+	if price != nil {
+		result.Price, result.Tier, result.Rate = price.Price, price.Tier, price.Rate
+	}
+	if summation != nil {
+		result.Delivered, result.Received = summation.Delivered, summation.Received
+	}
+	return result, true
+}
+
+func (s *MemoryStore) Update(key MeterKey, update func(Reading) Reading) (Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.latest(key)
+	if !ok {
+		r = Reading{Gateway: key.Gateway, Meter: key.Meter}
+	}
+	r = update(r)
+	s.append(r)
+	return r, nil
+}
+
+func (s *MemoryStore) Range(from, to time.Time) []Reading {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []Reading{}
+	for i := 0; i < s.count; i++ {
+		r := s.at(i)
+		if r.Time.Before(from) || (!to.IsZero() && !r.Time.Before(to)) {
+			continue
+		}
+		result = append(result, r)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result
+}
+
+// Merge puts the readings in time order among those held. Once the store is
+// full the oldest are dropped, so readings older than all of those held may
+// not be added at all.
+func (s *MemoryStore) Merge(readings []Reading) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]Reading, s.count)
+	for i := range all {
+		all[i] = s.at(i)
+	}
+	added := newReadings(all, readings)
+	if len(added) == 0 {
+		return 0, nil
+	}
+	all = append(all, added...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	if len(all) > len(s.buf) {
+		all = all[len(all)-len(s.buf):]
+	}
+	s.start, s.count = 0, copy(s.buf, all)
+	// Count the ones that weren't dropped straight away
+	isNew := make(map[readingKey]bool, len(added))
+	for _, r := range added {
+		isNew[r.mergeKey()] = true
+	}
+	kept := 0
+	for _, r := range all {
+		if isNew[r.mergeKey()] {
+			kept++
+		}
+	}
+	return kept, nil
+}
+
+// Len is the number of readings currently held
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+// The i'th oldest reading; callers must hold the lock
+func (s *MemoryStore) at(i int) Reading {
+	return s.buf[(s.start+i)%len(s.buf)]
+}
+
+// The earliest reading held; callers must hold the lock
+func (s *MemoryStore) oldest() (Reading, bool) {
+	if s.count == 0 {
+		return Reading{}, false
+	}
+	oldest := s.at(0)
+	for i := 1; i < s.count; i++ {
+		if r := s.at(i); r.Time.Before(oldest.Time) {
+			oldest = r
+		}
+	}
+	return oldest, true
+}
+
+// PersistentStore writes every reading through to a Backend and keeps the
+// most recent ones in memory. Range queries reaching further back than the
+// memory store are answered from the backend.
+type PersistentStore struct {
+	cache   *MemoryStore
+	backend Backend
+	// mu makes reading and writing back one step in Update and Merge
+	mu sync.Mutex
+}
+
+// NewPersistentStore fills the cache with the most recent readings from the
+// backend
+func NewPersistentStore(cache *MemoryStore, backend Backend) (*PersistentStore, error) {
+	stored, err := backend.Read(time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) > len(cache.buf) {
+		stored = stored[len(stored)-len(cache.buf):]
+	}
+	for _, r := range stored {
+		cache.Append(r)
+	}
+	return &PersistentStore{cache: cache, backend: backend}, nil
+}
+
+func (s *PersistentStore) Append(r Reading) error {
+	if err := s.backend.Write(r); err != nil {
+		return err
+	}
+	return s.cache.Append(r)
+}
+
+func (s *PersistentStore) Update(key MeterKey, update func(Reading) Reading) (Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.cache.Latest(key)
+	if !ok {
+		r = Reading{Gateway: key.Gateway, Meter: key.Meter}
+	}
+	r = update(r)
+	return r, s.Append(r)
+}
+
+// Merge writes the readings that aren't already in the backend through to it
+// in one batch and merges them into the cache
+func (s *PersistentStore) Merge(readings []Reading) (int, error) {
+	if len(readings) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, to := readings[0].Time, readings[0].Time
+	for _, r := range readings {
+		if r.Time.Before(from) {
+			from = r.Time
+		}
+		if r.Time.After(to) {
+			to = r.Time
+		}
+	}
+	stored, err := s.backend.Read(from, to.Add(time.Nanosecond))
+	if err != nil {
+		return 0, err
+	}
+	added := newReadings(stored, readings)
+	if err := s.backend.WriteBatch(added); err != nil {
+		return 0, err
+	}
+	s.cache.Merge(added)
+	return len(added), nil
+}
+
+func (s *PersistentStore) Latest(key MeterKey) (Reading, bool) {
+	return s.cache.Latest(key)
+}
+
+func (s *PersistentStore) Range(from, to time.Time) []Reading {
+	s.cache.mu.RLock()
+	oldest, ok := s.cache.oldest()
+	full := s.cache.count == len(s.cache.buf)
+	s.cache.mu.RUnlock()
+	if !full || (ok && !from.Before(oldest.Time)) {
+		return s.cache.Range(from, to)
+	}
+	result, err := s.backend.Read(from, to)
+	if err != nil {
+		log.Printf("Reading from storage: %v", err)
+	}
+	return result
+}
+
+// Compact runs the backend's compaction periodically until stop is closed
+func (s *PersistentStore) Compact(every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.backend.Compact(); err != nil {
+				log.Printf("Compacting storage: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *PersistentStore) Close() error {
+	return s.backend.Close()
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreWraps(t *testing.T) {
+	store := NewMemoryStore(3)
+	if _, ok := store.Latest(MeterKey{}); ok {
+		t.Errorf("Empty store has a latest reading")
+	}
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		store.Append(Reading{Time: start.Add(time.Duration(i) * time.Minute), Demand: Power(i)})
+	}
+	if store.Len() != 3 {
+		t.Errorf("Got %d readings instead of 3", store.Len())
+	}
+	latest, ok := store.Latest(MeterKey{})
+	if !ok || latest.Demand != 4 {
+		t.Errorf("Got latest %+v instead of demand 4", latest)
+	}
+	all := store.Range(time.Time{}, time.Time{})
+	for i, r := range all {
+		if r.Demand != Power(i+2) {
+			t.Errorf("Reading %d has demand %v, expected %d", i, r.Demand, i+2)
+		}
+	}
+	some := store.Range(start.Add(3*time.Minute), start.Add(4*time.Minute))
+	if len(some) != 1 || some[0].Demand != 3 {
+		t.Errorf("Got %+v instead of just demand 3", some)
+	}
+}
+
+func TestMemoryStoreConcurrent(t *testing.T) {
+	store := NewMemoryStore(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Append(Reading{Time: time.Now(), Demand: Power(i)})
+				store.Latest(MeterKey{})
+				store.Range(time.Time{}, time.Time{})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if store.Len() != 10 {
+		t.Errorf("Got %d readings instead of 10", store.Len())
+	}
+}
+
+func TestMemoryStoreUpdate(t *testing.T) {
+	store := NewMemoryStore(10)
+	key := MeterKey{"f0:ad:4e:00:ce:69", "00:07:81:00:00:7d:67:bb"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// Each update builds on the last, so none may be lost
+				store.Update(key, func(r Reading) Reading {
+					r.Time = time.Now()
+					r.Tier++
+					return r
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	latest, ok := store.Latest(key)
+	if !ok || latest.Tier != 800 || latest.Key() != key {
+		t.Errorf("Got %+v instead of 800 updates", latest)
+	}
+}
+
+func TestMemoryStoreOutOfOrder(t *testing.T) {
+	store := NewMemoryStore(10)
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	// A batch of readings uploaded late
+	for _, minute := range []int{5, 6, 1, 2, 7} {
+		store.Append(Reading{Time: start.Add(time.Duration(minute) * time.Minute), Demand: Power(minute)})
+	}
+	all := store.Range(time.Time{}, time.Time{})
+	for i, expected := range []int{1, 2, 5, 6, 7} {
+		if all[i].Demand != Power(expected) {
+			t.Errorf("Reading %d has demand %v, expected %d", i, all[i].Demand, expected)
+		}
+	}
+}
+
+func TestMemoryStoreLatestByMeter(t *testing.T) {
+	store := NewMemoryStore(10)
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	first := MeterKey{"f0:ad:4e:00:ce:69", "00:07:81:00:00:7d:67:bb"}
+	second := MeterKey{"f0:ad:4e:00:ce:70", "00:07:81:00:00:7d:67:bc"}
+	store.Append(Reading{Time: start, Gateway: first.Gateway, Meter: first.Meter, Demand: 1})
+	store.Append(Reading{Time: start, Gateway: second.Gateway, Meter: second.Meter, Demand: 2})
+	if latest, ok := store.Latest(first); !ok || latest.Demand != 1 {
+		t.Errorf("Got %+v instead of demand 1", latest)
+	}
+	if latest, ok := store.Latest(second); !ok || latest.Demand != 2 {
+		t.Errorf("Got %+v instead of demand 2", latest)
+	}
+	if _, ok := store.Latest(MeterKey{first.Gateway, second.Meter}); ok {
+		t.Errorf("Got a reading for an unknown meter")
+	}
+}
+
+func TestMemoryStoreUpdateAfterHistory(t *testing.T) {
+	store := NewMemoryStore(10)
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	key := MeterKey{"f0:ad:4e:00:ce:69", "00:07:81:00:00:7d:67:bb"}
+	price := Price{Money{797, 4, cad}}
+	store.Append(Reading{Time: start.Add(10 * time.Minute), Gateway: key.Gateway, Meter: key.Meter, Price: price, Tier: 2, Fragment: "PriceCluster"})
+	store.Append(Reading{Time: start.Add(11 * time.Minute), Gateway: key.Gateway, Meter: key.Meter, Demand: 1.5, Price: price, Tier: 2, Fragment: "InstantaneousDemand"})
+	// A demand reading uploaded late, then history without demand or price
+	store.Append(Reading{Time: start.Add(5 * time.Minute), Gateway: key.Gateway, Meter: key.Meter, Demand: 9, Fragment: "InstantaneousDemand"})
+	store.Merge([]Reading{{Time: start.Add(12 * time.Minute), Gateway: key.Gateway, Meter: key.Meter, Delivered: 100, Fragment: "HistoryData"}})
+	r, _ := store.Update(key, func(r Reading) Reading {
+		r.Time = start.Add(13 * time.Minute)
+		r.Fragment = "CurrentSummation"
+		return r
+	})
+	if r.Demand != 1.5 || r.Price != price || r.Tier != 2 || r.Delivered != 100 {
+		t.Errorf("Got %+v instead of the newest demand, price and summation", r)
+	}
+}
+
+func TestMemoryStoreMerge(t *testing.T) {
+	store := NewMemoryStore(4)
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	store.Append(Reading{Time: start, Demand: 1})
+	store.Append(Reading{Time: start.Add(10 * time.Minute), Demand: 4})
+	backfill := []Reading{
+		{Time: start, Demand: 100},
+		{Time: start.Add(5 * time.Minute), Demand: 2},
+		{Time: start.Add(7 * time.Minute), Demand: 3},
+		{Time: start.Add(5 * time.Minute), Demand: 200},
+	}
+	if n, err := store.Merge(backfill); n != 2 || err != nil {
+		t.Errorf("Merged %d readings, %v, instead of 2", n, err)
+	}
+	if n, _ := store.Merge(backfill); n != 0 {
+		t.Errorf("Merged %d readings the second time", n)
+	}
+	all := store.Range(time.Time{}, time.Time{})
+	for i, r := range all {
+		if r.Demand != Power(i+1) {
+			t.Errorf("Reading %d is %+v", i, r)
+		}
+	}
+	latest, _ := store.Latest(MeterKey{})
+	if latest.Demand != 4 {
+		t.Errorf("Got latest %+v instead of demand 4", latest)
+	}
+	// Too old to be kept once the store is full
+	if n, _ := store.Merge([]Reading{{Time: start.Add(-time.Minute)}}); n != 0 {
+		t.Errorf("Merged %d readings older than a full store", n)
+	}
+}
+
+func TestMemoryStoreMergeOntoDemand(t *testing.T) {
+	store := NewMemoryStore(4)
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	store.Append(Reading{Time: start, Demand: 1, Fragment: "InstantaneousDemand"})
+	history := []Reading{{Time: start, Delivered: 10, Fragment: "HistoryData"}}
+	if n, err := store.Merge(history); n != 1 || err != nil {
+		t.Errorf("Merged %d readings, %v, instead of 1", n, err)
+	}
+	if n, _ := store.Merge(history); n != 0 {
+		t.Errorf("Merged %d readings the second time", n)
+	}
+	latest, _ := store.Latest(MeterKey{})
+	if latest.Demand != 1 || latest.Delivered != 10 {
+		t.Errorf("Got latest %+v instead of demand 1 and delivered 10", latest)
+	}
+}
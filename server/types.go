@@ -4,10 +4,11 @@ import (
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
-	"github.com/rmg/iso4217"
-	"math"
+	"html"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type HexInt int64
@@ -18,9 +19,106 @@ func (i *HexInt) UnmarshalText(b []byte) error {
 	return err
 }
 
+func (i HexInt) MarshalText() ([]byte, error) {
+	if i < 0 {
+		return []byte(fmt.Sprintf("-0x%02x", -int64(i))), nil
+	}
+	return []byte(fmt.Sprintf("0x%02x", int64(i))), nil
+}
+
+// The EAGLE reports times as seconds since 00:00:00 01Jan2000 UTC
+var eagleEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// The EAGLE uses 0xffffffff to mean "now" for start times and "forever" for
+// end times
+const eagleTimeSentinel = 0xffffffff
+
+// EagleTime is a time sent by the EAGLE as up to 8 hex digits of seconds since
+// 00:00:00 01Jan2000 UTC
+type EagleTime time.Time
+
+func NewEagleTime(t time.Time) EagleTime {
+	return EagleTime(t.UTC().Truncate(time.Second))
+}
+
+func (t EagleTime) Time() time.Time {
+	return time.Time(t)
+}
+
+// Seconds since the EAGLE's epoch
+func (t EagleTime) Seconds() int64 {
+	return int64(t.Time().Sub(eagleEpoch) / time.Second)
+}
+
+// IsSentinel reports whether t is 0xffffffff, meaning "now" or "forever"
+func (t EagleTime) IsSentinel() bool {
+	return t.Seconds() == eagleTimeSentinel
+}
+
+func (t EagleTime) String() string {
+	if t.IsSentinel() {
+		return "forever"
+	}
+	return t.Time().Format(time.RFC3339)
+}
+
+func (t *EagleTime) UnmarshalText(b []byte) error {
+	secs, err := strconv.ParseUint(string(b), 0, 32)
+	*t = EagleTime(eagleEpoch.Add(time.Duration(secs) * time.Second))
+	return err
+}
+
+// MarshalText gives the time as the EAGLE sends it. The zero time is sent as
+// 0x00000000, which commands take to mean the most recent.
+func (t EagleTime) MarshalText() ([]byte, error) {
+	switch {
+	case t.Time().IsZero():
+		return []byte("0x00000000"), nil
+	case t.IsSentinel():
+		return []byte("0xffffffff"), nil
+	}
+	secs := t.Seconds()
+	if secs < 0 || secs > eagleTimeSentinel {
+		return nil, fmt.Errorf("%s can't be sent to an EAGLE", t)
+	}
+	return []byte(fmt.Sprintf("0x%08x", secs)), nil
+}
+
+// MarshalJSON gives the time in RFC 3339, or null for the sentinel
+func (t EagleTime) MarshalJSON() ([]byte, error) {
+	if t.IsSentinel() {
+		return []byte("null"), nil
+	}
+	return t.Time().MarshalJSON()
+}
+
+func (t *EagleTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*t = EagleTime(eagleEpoch.Add(eagleTimeSentinel * time.Second))
+		return nil
+	}
+	return (*time.Time)(t).UnmarshalJSON(b)
+}
+
+// Apply the multiplier and divisor to a raw value, treating zero as 1
+func scale(raw, mult, div HexInt) float64 {
+	if mult == 0 {
+		mult = 1
+	}
+	if div == 0 {
+		div = 1
+	}
+	return float64(raw) * float64(mult) / float64(div)
+}
+
 type YNBool bool
 
+// UnmarshalText takes Y to be true and anything else, even nothing, false
 func (v *YNBool) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*v = false
+		return nil
+	}
 	switch b[0] {
 	case 'Y', 'y':
 		*v = true
@@ -39,19 +137,61 @@ func (m MacAddrHex) String() string {
 }
 
 func (m *MacAddrHex) UnmarshalText(b []byte) error {
-	bytes, err := hex.DecodeString(string(b[2:]))
+	bytes, err := hex.DecodeString(strings.TrimPrefix(string(b), "0x"))
 	*m = MacAddrHex(bytes)
 	return err
 }
 
+// MarshalText gives the address in hex like the EAGLE sends it
+func (m MacAddrHex) MarshalText() ([]byte, error) {
+	if len(m) == 0 {
+		return []byte{}, nil
+	}
+	return []byte("0x" + hex.EncodeToString(m)), nil
+}
+
 type RainforestDocument struct {
 	MacId     MacAddrHex `xml:"macId,attr"`
 	Version   string     `xml:"version,attr"`
 	Timestamp string     `xml:"timestamp,attr"`
 }
 
+// The parts of any fragment needed to route it and to know where it came from
 type RequestFragment struct {
-	XMLName xml.Name
+	XMLName     xml.Name
+	DeviceMacId MacAddrHex
+	MeterMacId  MacAddrHex
+	CoordMacId  MacAddrHex // the meter in NetworkInfo
+	// badMac is why one of the MAC addresses couldn't be parsed, if it
+	// couldn't; that one is left nil
+	badMac error
+}
+
+// UnmarshalXML keeps going past a MAC address that can't be parsed, so just
+// that fragment can be skipped
+func (f *RequestFragment) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	raw := struct {
+		DeviceMacId, MeterMacId, CoordMacId string
+	}{}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+	*f = RequestFragment{XMLName: start.Name}
+	for _, mac := range []struct {
+		text string
+		addr *MacAddrHex
+	}{{raw.DeviceMacId, &f.DeviceMacId}, {raw.MeterMacId, &f.MeterMacId}, {raw.CoordMacId, &f.CoordMacId}} {
+		if mac.text == "" {
+			continue
+		}
+		if err := mac.addr.UnmarshalText([]byte(mac.text)); err != nil {
+			*mac.addr = nil
+			if f.badMac == nil {
+				f.badMac = fmt.Errorf("bad MAC address %q: %v", mac.text, err)
+			}
+		}
+	}
+	return nil
 }
 
 type Request struct {
@@ -80,7 +220,7 @@ type DeviceInfo struct {
 
 type NetworkInfoFragment struct {
 	DeviceMacId MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
-	CoordMacId  string     // 16 hex digits MAC Address of Meter
+	CoordMacId  MacAddrHex // 16 hex digits MAC Address of Meter
 	Status      string
 	// Initializing | Network
 	// Discovery | Joining | Join: Fail
@@ -96,7 +236,7 @@ type NetworkInfoFragment struct {
 	ExtPanId     string // 16 hex digits; Optional Extended PAN ID of the ZigBee network
 	Channel      string // 11 – 26; Optional Indicates the radio channel on which the EAGLE™ is operating
 	ShortAddr    string // 4 hex digits; Optional The short address assigned to the EAGLE™ by the network coordinator
-	LinkStrength string // 0x00 – 0x64 Indicates the strength of the radio link
+	LinkStrength HexInt // 0x00 – 0x64 Indicates the strength of the radio link
 }
 
 type NetworkInfo struct {
@@ -107,8 +247,8 @@ type NetworkInfo struct {
 type InstantaneousDemandFragment struct {
 	XMLName             xml.Name
 	DeviceMacId         MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
-	MeterMacId          string     // 16 hex digits MAC Address of Meter
-	TimeStamp           string     // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when demand data was received from meter.
+	MeterMacId          MacAddrHex // 16 hex digits MAC Address of Meter
+	TimeStamp           EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when demand data was received from meter.
 	Demand              HexInt     // 6 hex digits The raw instantaneous demand value. This is a 24-bit signed integer.
 	Multiplier          HexInt     // Up to 8 hex digits The multiplier; if zero, use 1
 	Divisor             HexInt     // Up to 8 hex digits The divisor; if zero, use 1
@@ -124,21 +264,19 @@ type InstantaneousDemand struct {
 
 func (i InstantaneousDemand) String() string {
 	d := i.InstantaneousDemand
-	demand := float64(d.Demand)
-	mult := float64(d.Multiplier)
-	div := float64(d.Divisor)
-	if div == 0 {
-		div = 1
-	}
-	if mult == 0 {
-		mult = 1
-	}
 	format := fmt.Sprintf("%%%d.%dfkW", d.DigitsLeft, d.DigitsRight)
-	return fmt.Sprintf(format, demand*mult/div)
+	return fmt.Sprintf(format, float64(i.Power()))
 }
 
-func (i InstantaneousDemand) Int() int {
-	return int(i.InstantaneousDemand.Demand)
+func (i InstantaneousDemand) Time() time.Time {
+	return i.InstantaneousDemand.TimeStamp.Time()
+}
+
+// Power is the demand with the multiplier and divisor applied. Demand is a
+// 24-bit signed value so exports to the grid come out negative.
+func (i InstantaneousDemand) Power() Power {
+	d := i.InstantaneousDemand
+	return Power(scale(int24(d.Demand), d.Multiplier, d.Divisor))
 }
 
 // <PriceCluster>
@@ -156,14 +294,14 @@ func (i InstantaneousDemand) Int() int {
 type PriceClusterFragment struct {
 	DeviceMacId    MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
 	MeterMacId     MacAddrHex // 16 hex digits MAC Address of Meter
-	TimeStamp      HexInt     // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when price data was received from meter or set by user
+	TimeStamp      EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when price data was received from meter or set by user
 	Price          HexInt     // Up to 8 hex digits Price from meter or set by user; will be zero if no price is set
 	Currency       HexInt     // Up to 4 hex digits Currency being used; value of this field matches the values defined by ISO 4217
 	TrailingDigits HexInt     // Up to 2 hex digits The number of implicit decimal places in the price. (e.g. 2 means divide Price by 100).
-	Tier           string     // 1 - 5 The price Tier in effect.
-	//   <StartTime>0xffffffff</StartTime>
-	//   <Duration>0xffff</Duration>
-	RateLabel string // Text Rate label for the current price tier; will be “Set by User” if a user-defined price is set
+	Tier           HexInt     // 1 - 5 The price Tier in effect.
+	StartTime      EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when the price takes effect; 0xffffffff means now
+	Duration       HexInt     // Up to 4 hex digits Minutes the price is in effect for; 0xffff means until changed
+	RateLabel      string     // Text Rate label for the current price tier; will be “Set by User” if a user-defined price is set
 }
 
 type PriceCluster struct {
@@ -172,28 +310,37 @@ type PriceCluster struct {
 }
 
 func (p PriceCluster) String() string {
-	name, _ := iso4217.ByCode(int(p.PriceCluster.Currency))
-	price := int(p.PriceCluster.Price)
-	div := int(math.Pow10(int(p.PriceCluster.TrailingDigits)))
-	if div == 1 {
-		return fmt.Sprintf("%d %s", price, name)
+	return p.Price().Money.String()
+}
+
+func (p PriceCluster) Time() time.Time {
+	return p.PriceCluster.TimeStamp.Time()
+}
+
+// Start is when the price takes effect
+func (p PriceCluster) Start() time.Time {
+	if p.PriceCluster.StartTime.IsSentinel() || p.PriceCluster.StartTime.Time().IsZero() {
+		return p.Time()
 	}
-	return fmt.Sprintf("%d.%d %s", price/div, price%div, name)
+	return p.PriceCluster.StartTime.Time()
 }
 
-func (p PriceCluster) Int() int {
-	return int(p.PriceCluster.Price)
+func (p PriceCluster) Price() Price {
+	c := p.PriceCluster
+	return Price{Money{int64(c.Price), int(c.TrailingDigits), int(c.Currency)}}
 }
 
 type MessageFragment struct {
 	DeviceMacId          MacAddrHex //  16 hex digits MAC Address of EAGLE™ ZigBee radio
-	MeterMacId           string     //  16 hex digits MAC Address of Meter
-	TimeStamp            string     //  Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when message was received from meter
-	Id                   string     //  Up to 8 hex digits Message ID from meter
+	MeterMacId           MacAddrHex //  16 hex digits MAC Address of Meter
+	TimeStamp            EagleTime  //  Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when message was received from meter
+	Id                   HexInt     //  Up to 8 hex digits Message ID from meter
 	Text                 string     //  Text Contents of message, HTML encoded: &gt; replaces the > character &lt; replaces the < character &amp; replaces the & character &quot; replaces the " character
 	Priority             string     //  Low | Medium | High | Critical Message priority
-	ConfirmationRequired string     //  Y | N Y: a user confirmation is required; N: a user confirmation is not required (default)
-	Confirmed            string     //  Y | N Y: the user confirmation has been sent; N: the user confirmation has not been sent (default)
+	StartTime            EagleTime  //  Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when the message starts being shown
+	Duration             HexInt     //  Up to 4 hex digits Minutes the message is shown for; 0xffff means until changed
+	ConfirmationRequired YNBool     //  Y | N Y: a user confirmation is required; N: a user confirmation is not required (default)
+	Confirmed            YNBool     //  Y | N Y: the user confirmation has been sent; N: the user confirmation has not been sent (default)
 	Queue                string     //  Active | Cancel Pending Active: Indicates message is in active queue Cancel Pending: Indicates message is in cancel pending queue
 }
 
@@ -202,17 +349,44 @@ type Message struct {
 	Message MessageFragment
 }
 
+// MessageCluster is the same as Message under the name newer firmware uses
+type MessageCluster struct {
+	RainforestDocument
+	MessageCluster MessageFragment
+}
+
+func (m MessageFragment) Time() time.Time {
+	return m.TimeStamp.Time()
+}
+
+// Text of the message with the HTML entities decoded
+func (m MessageFragment) String() string {
+	return html.UnescapeString(m.Text)
+}
+
+// Expires is when the message stops being shown, or zero if it doesn't
+func (m MessageFragment) Expires() time.Time {
+	if m.Duration == 0 || m.Duration == 0xffff {
+		return time.Time{}
+	}
+	start := m.StartTime.Time()
+	if m.StartTime.IsSentinel() || start.IsZero() {
+		start = m.Time()
+	}
+	return start.Add(time.Duration(m.Duration) * time.Minute)
+}
+
 type CurrentSummationFragment struct {
 	DeviceMacId         MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
-	MeterMacId          string     // 16 hex digits MAC Address of Meter
-	TimeStamp           string     // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when demand data was received from meter.
-	SummationDelivered  string     // Up to 8 hex digitsThe raw value of the total summation of commodity delivered from the utility to the user.
-	SummationReceived   string     // Up to 8 hex digits The raw value of the total summation of commodity received from the user by the utility.
-	Multiplier          string     // Up to 8 hex digits The multiplier; if zero, use 1
-	Divisor             string     // Up to 8 hex digits The divisor; if zero, use 1
-	DigitsRight         string     // Up to 2 hex digits Number of digits to the right of the decimal point to display
-	DigitsLeft          string     // Up to 2 hex digits Number of digits to the left of the decimal point to display
-	SuppressLeadingZero string     // Y | N Y: Do not display leading zeros N: Display leading zeros
+	MeterMacId          MacAddrHex // 16 hex digits MAC Address of Meter
+	TimeStamp           EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when demand data was received from meter.
+	SummationDelivered  HexInt     // Up to 8 hex digitsThe raw value of the total summation of commodity delivered from the utility to the user.
+	SummationReceived   HexInt     // Up to 8 hex digits The raw value of the total summation of commodity received from the user by the utility.
+	Multiplier          HexInt     // Up to 8 hex digits The multiplier; if zero, use 1
+	Divisor             HexInt     // Up to 8 hex digits The divisor; if zero, use 1
+	DigitsRight         HexInt     // Up to 2 hex digits Number of digits to the right of the decimal point to display
+	DigitsLeft          HexInt     // Up to 2 hex digits Number of digits to the left of the decimal point to display
+	SuppressLeadingZero YNBool     // Y | N Y: Do not display leading zeros N: Display leading zeros
 }
 
 type CurrentSummation struct {
@@ -220,6 +394,28 @@ type CurrentSummation struct {
 	CurrentSummation CurrentSummationFragment
 }
 
+func (c CurrentSummation) Time() time.Time {
+	return c.CurrentSummation.TimeStamp.Time()
+}
+
+// Delivered is the total energy delivered to the premises
+func (c CurrentSummation) Delivered() Energy {
+	s := c.CurrentSummation
+	return Energy(scale(s.SummationDelivered, s.Multiplier, s.Divisor))
+}
+
+// Received is the total energy received from the premises
+func (c CurrentSummation) Received() Energy {
+	s := c.CurrentSummation
+	return Energy(scale(s.SummationReceived, s.Multiplier, s.Divisor))
+}
+
+func (c CurrentSummation) String() string {
+	s := c.CurrentSummation
+	format := fmt.Sprintf("%%%d.%dfkWh", s.DigitsLeft, s.DigitsRight)
+	return fmt.Sprintf(format, float64(c.Delivered()))
+}
+
 type MeterInfoFragment struct {
 	DeviceMacId MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
 	MeterMacId  string     // 16 hex digits MAC Address of Meter
@@ -238,9 +434,9 @@ type MeterInfo struct {
 
 type FastPollStatusFragment struct {
 	DeviceMacId MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
-	MeterMacId  string     // 16 hex digits MAC Address of Meter
-	Frequency   string     // 0x01 – 0xFF Frequency to poll meter, in seconds
-	EndTime     string     // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when fast poll will end. If EndTime is earlier than the current time, then fast poll mode is turned off.
+	MeterMacId  MacAddrHex // 16 hex digits MAC Address of Meter
+	Frequency   HexInt     // 0x01 – 0xFF Frequency to poll meter, in seconds
+	EndTime     EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when fast poll will end. If EndTime is earlier than the current time, then fast poll mode is turned off.
 }
 
 type FastPollStatus struct {
@@ -248,8 +444,28 @@ type FastPollStatus struct {
 	FastPollStatus FastPollStatusFragment
 }
 
+// Interval is how often the meter is being polled
+func (f FastPollStatusFragment) Interval() time.Duration {
+	return time.Duration(f.Frequency) * time.Second
+}
+
+// <HistoryData>
+//   <CurrentSummation>
+//     <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+//     <MeterMacId>0x00078100007d67bb</MeterMacId>
+//     <TimeStamp>0x1b8d9a00</TimeStamp>
+//     <SummationDelivered>0x0000000001321a5f</SummationDelivered>
+//     <SummationReceived>0x0000000000000000</SummationReceived>
+//     <Multiplier>0x00000001</Multiplier>
+//     <Divisor>0x000003e8</Divisor>
+//     <DigitsRight>0x01</DigitsRight>
+//     <DigitsLeft>0x06</DigitsLeft>
+//     <SuppressLeadingZero>Y</SuppressLeadingZero>
+//   </CurrentSummation>
+//   ...
+// </HistoryData>
 type HistoryDataFragment struct {
-	CurrentSummation []CurrentSummationFragment // `xml:"HistoryData>CurrentSummation"`
+	CurrentSummation []CurrentSummationFragment `xml:"CurrentSummation"` // One per point in time
 }
 
 type HistoryData struct {
@@ -258,29 +474,138 @@ type HistoryData struct {
 }
 
 type ProfileDataFragment struct {
-	DeviceMacId MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
-	MeterMacId  string     // 16 hex digits MAC Address of Meter
-	EndTime     string     // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) of the end of the most chronologically recent interval; 0x0 indicates the most recent interval block.
-	Status      string     //  0x0 – 0x05 Status of returned data:
-	// 0x00 Success
-	// 0x01 Undefined Interval Channel requested
-	// 0x02 Interval Channel not supported
-	// 0x03 Invalid End Time
-	// 0x04 More periods Requested than can be returned
-	// 0x05 No intervals available for the requested time
-	ProfileIntervalPeriod string // 0 - 7
-	// The length of each sampling interval:
-	// 0 Daily
-	// 1 60 minutes
-	// 2 30 minutes
-	// 3 15 minutes
-	// 4 10 minutes
-	// 5 7.5 minutes
-	// 6 5 minutes
-	// 7 2.5 minutes
-	NumberOfPeriodsDelivered string // 0x0 – 0xFF The number of intervals being returned.
-	IntervalDataX            string // Up to 6 hex digits
-	// X = 1-12. Series of up to 12 interval data points from the meter. Most recent interval is first; oldest is last. Invalid intervals are marked as 0xFFFFFF.
+	DeviceMacId              MacAddrHex    // 16 hex digits MAC Address of EAGLE™ ZigBee radio
+	MeterMacId               MacAddrHex    // 16 hex digits MAC Address of Meter
+	EndTime                  EagleTime     // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) of the end of the most chronologically recent interval; 0x0 indicates the most recent interval block.
+	Status                   ProfileStatus // 0x0 – 0x05 Status of returned data
+	ProfileIntervalPeriod    HexInt        // 0 - 7 The length of each sampling interval, see profilePeriods
+	NumberOfPeriodsDelivered HexInt        // 0x0 – 0xFF The number of intervals being returned.
+	// IntervalData1 to IntervalData12, up to 6 hex digits each. Series of up
+	// to 12 interval data points from the meter. Most recent interval is
+	// first; oldest is last. Invalid intervals are marked as 0xFFFFFF.
+	IntervalData []HexInt `xml:"-"`
+}
+
+// InvalidInterval marks an interval the meter has no data for
+const InvalidInterval = 0xffffff
+
+// The length of each sampling interval by ProfileIntervalPeriod
+var profilePeriods = []time.Duration{
+	24 * time.Hour,
+	60 * time.Minute,
+	30 * time.Minute,
+	15 * time.Minute,
+	10 * time.Minute,
+	7*time.Minute + 30*time.Second,
+	5 * time.Minute,
+	2*time.Minute + 30*time.Second,
+}
+
+// A ProfileStatus says whether the meter could return the intervals asked for
+type ProfileStatus HexInt
+
+func (s *ProfileStatus) UnmarshalText(b []byte) error {
+	return (*HexInt)(s).UnmarshalText(b)
+}
+
+var profileStatuses = map[ProfileStatus]string{
+	0x01: "undefined interval channel requested",
+	0x02: "interval channel not supported",
+	0x03: "invalid end time",
+	0x04: "more periods requested than can be returned",
+	0x05: "no intervals available for the requested time",
+}
+
+// Err is the status as an error, or nil for success
+func (s ProfileStatus) Err() error {
+	if s == 0 {
+		return nil
+	}
+	return s
+}
+
+func (s ProfileStatus) Error() string {
+	if msg, ok := profileStatuses[s]; ok {
+		return fmt.Sprintf("profile data status 0x%02x: %s", int(s), msg)
+	}
+	return fmt.Sprintf("profile data status 0x%02x", int(s))
+}
+
+// UnmarshalXML reads the numbered IntervalDataN elements into IntervalData
+// along with the fixed fields
+func (f *ProfileDataFragment) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type fixed ProfileDataFragment
+	v := struct {
+		fixed
+		Numbered []struct {
+			XMLName xml.Name
+			Value   HexInt `xml:",chardata"`
+		} `xml:",any"`
+	}{}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*f = ProfileDataFragment(v.fixed)
+	for _, e := range v.Numbered {
+		var n int
+		if _, err := fmt.Sscanf(e.XMLName.Local, "IntervalData%d", &n); err != nil {
+			continue
+		}
+		if n < 1 || n > 12 {
+			return fmt.Errorf("invalid interval number in %s", e.XMLName.Local)
+		}
+		for len(f.IntervalData) < n {
+			f.IntervalData = append(f.IntervalData, InvalidInterval)
+		}
+		f.IntervalData[n-1] = e.Value
+	}
+	return nil
+}
+
+// Period is the length of each interval
+func (f ProfileDataFragment) Period() (time.Duration, error) {
+	if f.ProfileIntervalPeriod < 0 || int(f.ProfileIntervalPeriod) >= len(profilePeriods) {
+		return 0, fmt.Errorf("unknown profile interval period %d", f.ProfileIntervalPeriod)
+	}
+	return profilePeriods[f.ProfileIntervalPeriod], nil
+}
+
+// An Interval is the energy used in one sampling interval
+type Interval struct {
+	Start  time.Time
+	End    time.Time
+	Energy Energy
+	// Valid is false if the meter marked the interval invalid
+	Valid bool
+}
+
+// Intervals gives the intervals oldest first, with the raw values scaled by
+// the multiplier and divisor of the meter's summation. It fails if the meter
+// couldn't return them.
+func (f ProfileDataFragment) Intervals(multiplier, divisor HexInt) ([]Interval, error) {
+	if err := f.Status.Err(); err != nil {
+		return nil, err
+	}
+	period, err := f.Period()
+	if err != nil {
+		return nil, err
+	}
+	data := f.IntervalData
+	if n := int(f.NumberOfPeriodsDelivered); n < len(data) {
+		data = data[:n]
+	}
+	intervals := make([]Interval, len(data))
+	end := f.EndTime.Time()
+	for i, raw := range data {
+		interval := &intervals[len(data)-1-i]
+		interval.Start, interval.End = end.Add(-period), end
+		if raw != InvalidInterval {
+			interval.Energy = Energy(scale(raw, multiplier, divisor))
+			interval.Valid = true
+		}
+		end = interval.Start
+	}
+	return intervals, nil
 }
 
 type ProfileData struct {
@@ -320,28 +645,169 @@ type ProfileData struct {
 //   <Threshold1>0x000002c6</Threshold1>
 //   <Price2>0x000004ab</Price2>
 // </BlockPriceDetail>
+type BlockPriceDetailFragment struct {
+	DeviceMacId                      MacAddrHex // 16 hex digits MAC Address of EAGLE™ ZigBee radio
+	MeterMacId                       MacAddrHex // 16 hex digits MAC Address of Meter
+	TimeStamp                        EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when block price data was received from meter
+	CurrentStart                     EagleTime  // Up to 8 hex digits UTC Time (offset in seconds from 00:00:00 01Jan2000) when the current block period started
+	CurrentDuration                  HexInt     // Up to 4 hex digits Minutes the current block period lasts for; 0xffff means until changed
+	BlockPeriodConsumption           HexInt     // Up to 16 hex digits The raw value of the energy delivered so far in the block period
+	BlockPeriodConsumptionMultiplier HexInt     // Up to 8 hex digits The multiplier for BlockPeriodConsumption; if zero, use 1
+	BlockPeriodConsumptionDivisor    HexInt     // Up to 8 hex digits The divisor for BlockPeriodConsumption; if zero, use 1
+	NumberOfBlocks                   HexInt     // Up to 2 hex digits Number of price blocks
+	Multiplier                       HexInt     // Up to 8 hex digits The multiplier for the thresholds; if zero, use 1
+	Divisor                          HexInt     // Up to 8 hex digits The divisor for the thresholds; if zero, use 1
+	Currency                         HexInt     // Up to 4 hex digits Currency being used; value of this field matches the values defined by ISO 4217
+	TrailingDigits                   HexInt     // Up to 2 hex digits The number of implicit decimal places in the prices
+	Prices                           []HexInt   `xml:"-"` // PriceN, the raw price of block N+1
+	Thresholds                       []HexInt   `xml:"-"` // ThresholdN, the raw consumption at which block N+1 ends
+}
+
+// UnmarshalXML reads the numbered PriceN and ThresholdN elements into Prices
+// and Thresholds along with the fixed fields
+func (f *BlockPriceDetailFragment) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type fixed BlockPriceDetailFragment
+	v := struct {
+		fixed
+		Numbered []struct {
+			XMLName xml.Name
+			Value   HexInt `xml:",chardata"`
+		} `xml:",any"`
+	}{}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*f = BlockPriceDetailFragment(v.fixed)
+	for _, e := range v.Numbered {
+		var list *[]HexInt
+		var n int
+		if _, err := fmt.Sscanf(e.XMLName.Local, "Price%d", &n); err == nil {
+			list = &f.Prices
+		} else if _, err := fmt.Sscanf(e.XMLName.Local, "Threshold%d", &n); err == nil {
+			list = &f.Thresholds
+		} else {
+			continue
+		}
+		if n < 1 || n > 255 {
+			return fmt.Errorf("invalid block number in %s", e.XMLName.Local)
+		}
+		for len(*list) < n {
+			*list = append(*list, 0)
+		}
+		(*list)[n-1] = e.Value
+	}
+	return nil
+}
+
+type BlockPriceDetail struct {
+	RainforestDocument
+	BlockPriceDetail BlockPriceDetailFragment
+}
+
+func (b BlockPriceDetail) Time() time.Time {
+	return b.BlockPriceDetail.TimeStamp.Time()
+}
 
+// Consumption is the energy delivered so far in the block period
+func (b BlockPriceDetail) Consumption() Energy {
+	f := b.BlockPriceDetail
+	return Energy(scale(f.BlockPeriodConsumption, f.BlockPeriodConsumptionMultiplier, f.BlockPeriodConsumptionDivisor))
+}
+
+// Period is when the current block period started and when it ends, which is
+// zero if it lasts until changed
+func (b BlockPriceDetail) Period() (time.Time, time.Time) {
+	f := b.BlockPriceDetail
+	start := f.CurrentStart.Time()
+	if f.CurrentDuration == 0xffff {
+		return start, time.Time{}
+	}
+	return start, start.Add(time.Duration(f.CurrentDuration) * time.Minute)
+}
+
+// A Block is one step of block pricing. Threshold is the consumption in the
+// block period at which the next block starts; the last block has none.
+type Block struct {
+	Number    int    `json:"number"`
+	Price     Price  `json:"price"`
+	Threshold Energy `json:"threshold,omitempty"`
+}
+
+func (b BlockPriceDetail) Blocks() []Block {
+	f := b.BlockPriceDetail
+	blocks := make([]Block, len(f.Prices))
+	for i, price := range f.Prices {
+		blocks[i] = Block{Number: i + 1, Price: Price{Money{int64(price), int(f.TrailingDigits), int(f.Currency)}}}
+		if i < len(f.Thresholds) && i < len(f.Prices)-1 {
+			blocks[i].Threshold = Energy(scale(f.Thresholds[i], f.Multiplier, f.Divisor))
+		}
+	}
+	return blocks
+}
+
+// BlockStatus is where the meter is in its block pricing: the block it is in,
+// that block's price and how much more energy can be used before the next
+// block starts. Remaining is unset in the last block.
+type BlockStatus struct {
+	Gateway     string     `json:"gateway,omitempty"`
+	Meter       string     `json:"meter,omitempty"`
+	Time        time.Time  `json:"time"`
+	PeriodStart time.Time  `json:"period_start"`
+	PeriodEnd   *time.Time `json:"period_end,omitempty"`
+	Consumption Energy     `json:"consumption"`
+	Block       int        `json:"block"`
+	Price       Price      `json:"price"`
+	Remaining   Energy     `json:"remaining,omitempty"`
+	Blocks      []Block    `json:"blocks"`
+}
+
+func (b BlockPriceDetail) Status() BlockStatus {
+	status := BlockStatus{
+		Time:        b.Time(),
+		Consumption: b.Consumption(),
+		Blocks:      b.Blocks(),
+	}
+	start, end := b.Period()
+	status.PeriodStart = start
+	if !end.IsZero() {
+		status.PeriodEnd = &end
+	}
+	for _, block := range status.Blocks {
+		status.Block, status.Price = block.Number, block.Price
+		if block.Threshold == 0 {
+			break
+		}
+		if status.Consumption < block.Threshold {
+			status.Remaining = block.Threshold - status.Consumption
+			break
+		}
+	}
+	return status
+}
+
+// A Command is sent to the EAGLE's local API, POSTed as XML to
+// /cgi-bin/cgi_manager. Fields a command doesn't use are left out.
 type Command struct {
 	Name  string
-	MacId MacAddrHex
+	MacId MacAddrHex `xml:",omitempty"`
 }
 
 type RavenCommand struct {
 	Command
 	// set_fast_poll
-	Frequency HexInt
-	Duration  HexInt
+	Frequency HexInt `xml:",omitempty"`
+	Duration  HexInt `xml:",omitempty"`
 	// get_profile_data
-	DeviceMacId     MacAddrHex
-	MeterMacId      MacAddrHex
-	NumberOfPeriods HexInt
-	EndTime         HexInt
-	IntervalChannel string
+	DeviceMacId     MacAddrHex `xml:",omitempty"`
+	MeterMacId      MacAddrHex `xml:",omitempty"`
+	NumberOfPeriods HexInt     `xml:",omitempty"`
+	EndTime         *EagleTime `xml:",omitempty"`
+	IntervalChannel string     `xml:",omitempty"`
 	// set_schedule
 	// DeviceMacId MacAddrHex
-	Event string
+	Event string `xml:",omitempty"`
 	// Frequency HexInt
-	Enabled string
+	Enabled string `xml:",omitempty"`
 }
 
 type LocalCommand struct {
@@ -349,11 +815,25 @@ type LocalCommand struct {
 	// get_fast_poll_status
 	// ...
 	// get_history_data
-	StartTime HexInt
-	EndTime   HexInt
-	Frequency HexInt
+	StartTime *EagleTime `xml:",omitempty"`
+	EndTime   *EagleTime `xml:",omitempty"`
+	Frequency HexInt     `xml:",omitempty"`
 	//
 }
 
+// SetFastPoll asks the EAGLE to poll the meter every Frequency, 1 to 255
+// seconds, for Duration, up to 15 minutes
 type SetFastPoll struct {
+	MeterMacId MacAddrHex
+	Frequency  time.Duration
+	Duration   time.Duration
+}
+
+func (f SetFastPoll) Command(mac MacAddrHex) RavenCommand {
+	return RavenCommand{
+		Command:    Command{Name: "set_fast_poll", MacId: mac},
+		MeterMacId: f.MeterMacId,
+		Frequency:  HexInt(f.Frequency / time.Second),
+		Duration:   HexInt(f.Duration / time.Minute),
+	}
 }
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"testing"
+	"time"
 )
 
 func TestDeviceInfo(t *testing.T) {
@@ -77,8 +79,70 @@ func TestPriceCluster(t *testing.T) {
 		t.Errorf("error: %+v", err)
 		return
 	}
-	if out.String() != "0.797 CAD" {
-		t.Errorf("Got: '%s' instead of '0.797 CAD'", out)
+	if out.String() != "0.0797 CAD" {
+		t.Errorf("Got: '%s' instead of '0.0797 CAD'", out)
+	}
+}
+
+const blockPriceDetail = `<?xml version="1.0"?>
+  <rainforest macId="0xf0ad4e00ce69" timestamp="1355292588s">
+  <BlockPriceDetail>
+    <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+    <MeterMacId>0x00078100007d67bb</MeterMacId>
+    <TimeStamp>0x1b8d9c25</TimeStamp>
+    <CurrentStart>0x1b89a6a2</CurrentStart>
+    <CurrentDuration>0x2ad1</CurrentDuration>
+    <BlockPeriodConsumption>0x0000000000038fa2</BlockPeriodConsumption>
+    <BlockPeriodConsumptionMultiplier>0x00000001</BlockPeriodConsumptionMultiplier>
+    <BlockPeriodConsumptionDivisor>0x000003e8</BlockPeriodConsumptionDivisor>
+    <NumberOfBlocks>0x03</NumberOfBlocks>
+    <Multiplier>0x00000001</Multiplier>
+    <Divisor>0x00000001</Divisor>
+    <Currency>0x007c</Currency>
+    <TrailingDigits>0x04</TrailingDigits>
+    <Price1>0x0000031d</Price1>
+    <Threshold1>0x000000c8</Threshold1>
+    <Price3>0x00000500</Price3>
+    <Threshold2>0x000002c6</Threshold2>
+    <Price2>0x000004ab</Price2>
+  </BlockPriceDetail>
+  </rainforest>
+  `
+
+func TestBlockPriceDetail(t *testing.T) {
+	out := BlockPriceDetail{}
+	if err := xml.Unmarshal([]byte(blockPriceDetail), &out); err != nil {
+		t.Fatalf("error: %+v", err)
+	}
+	f := out.BlockPriceDetail
+	if len(f.Prices) != 3 || f.Prices[2] != 0x500 || len(f.Thresholds) != 2 || f.Thresholds[1] != 0x2c6 {
+		t.Errorf("Got prices %v and thresholds %v", f.Prices, f.Thresholds)
+	}
+	if f.MeterMacId.String() != "00:07:81:00:00:7d:67:bb" {
+		t.Errorf("Got meter %s", f.MeterMacId)
+	}
+	start, end := out.Period()
+	if d := end.Sub(start); d != 0x2ad1*time.Minute {
+		t.Errorf("Got a %v block period", d)
+	}
+	status := out.Status()
+	if status.Consumption != 233.378 {
+		t.Errorf("Got consumption %v instead of 233.378kWh", status.Consumption)
+	}
+	if status.Block != 2 || status.Price.String() != "0.1195 CAD/kWh" {
+		t.Errorf("Got block %d at %s instead of block 2 at 0.1195 CAD/kWh", status.Block, status.Price)
+	}
+	if remaining := round(float64(status.Remaining)); remaining != 476.622 {
+		t.Errorf("Got %v remaining instead of 476.622kWh", remaining)
+	}
+	if last := status.Blocks[2]; last.Threshold != 0 {
+		t.Errorf("The last block has a threshold: %+v", last)
+	}
+
+	f.BlockPeriodConsumption = 800000
+	out.BlockPriceDetail = f
+	if status := out.Status(); status.Block != 3 || status.Remaining != 0 {
+		t.Errorf("Got block %d with %v remaining instead of the last block", status.Block, status.Remaining)
 	}
 }
 
@@ -112,3 +176,160 @@ func TestFragmentNamer(t *testing.T) {
 		}
 	}
 }
+
+func TestCurrentSummation(t *testing.T) {
+	const in = `<?xml version="1.0"?>
+  <rainforest macId="0xf0ad4e00ce69" timestamp="1355292588s">
+  <CurrentSummation>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <MeterMacId>0x00178d0000000004</MeterMacId>
+    <TimeStamp>0x185adc1d</TimeStamp>
+    <SummationDelivered>0x0000000001321a5f</SummationDelivered>
+    <SummationReceived>0x00000000000003e8</SummationReceived>
+    <Multiplier>0x00000001</Multiplier>
+    <Divisor>0x000003e8</Divisor>
+    <DigitsRight>0x01</DigitsRight>
+    <DigitsLeft>0x06</DigitsLeft>
+    <SuppressLeadingZero>Y</SuppressLeadingZero>
+  </CurrentSummation>
+  </rainforest>
+  `
+	out := CurrentSummation{}
+	err := xml.Unmarshal([]byte(in), &out)
+	if err != nil {
+		t.Errorf("error: %+v", err)
+		return
+	}
+	if out.Delivered() != 20060.767 {
+		t.Errorf("Got: %v instead of 20060.767 delivered", out.Delivered())
+	}
+	if out.Received() != 1 {
+		t.Errorf("Got: %v instead of 1 received", out.Received())
+	}
+	expected := time.Date(2012, time.December, 12, 6, 9, 33, 0, time.UTC)
+	if !out.Time().Equal(expected) {
+		t.Errorf("Got: %v instead of %v", out.Time(), expected)
+	}
+	if out.String() != "20060.8kWh" {
+		t.Errorf("Got: '%s' instead of '20060.8kWh'", out)
+	}
+}
+
+func TestProfileData(t *testing.T) {
+	const in = `<ProfileData>
+    <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+    <MeterMacId>0x00078100007d67bb</MeterMacId>
+    <EndTime>0x1b8d9cd0</EndTime>
+    <Status>0x00</Status>
+    <ProfileIntervalPeriod>0x03</ProfileIntervalPeriod>
+    <NumberOfPeriodsDelivered>0x04</NumberOfPeriodsDelivered>
+    <IntervalData1>0x0000fa</IntervalData1>
+    <IntervalData2>0x0001f4</IntervalData2>
+    <IntervalData3>0xffffff</IntervalData3>
+    <IntervalData4>0x000064</IntervalData4>
+  </ProfileData>`
+	out := ProfileDataFragment{}
+	if err := xml.Unmarshal([]byte(in), &out); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(out.IntervalData) != 4 || out.IntervalData[2] != InvalidInterval {
+		t.Errorf("Got interval data %v", out.IntervalData)
+	}
+	intervals, err := out.Intervals(1, 1000)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	end := time.Date(2014, time.August, 25, 7, 5, 52, 0, time.UTC)
+	expected := []Interval{
+		{end.Add(-60 * time.Minute), end.Add(-45 * time.Minute), 0.1, true},
+		{end.Add(-45 * time.Minute), end.Add(-30 * time.Minute), 0, false},
+		{end.Add(-30 * time.Minute), end.Add(-15 * time.Minute), 0.5, true},
+		{end.Add(-15 * time.Minute), end, 0.25, true},
+	}
+	if len(intervals) != len(expected) {
+		t.Fatalf("Got %+v instead of %+v", intervals, expected)
+	}
+	for i, interval := range intervals {
+		if !interval.Start.Equal(expected[i].Start) || !interval.End.Equal(expected[i].End) || interval.Energy != expected[i].Energy || interval.Valid != expected[i].Valid {
+			t.Errorf("Interval %d is %+v instead of %+v", i, interval, expected[i])
+		}
+	}
+
+	out.Status = 0x05
+	if _, err := out.Intervals(1, 1000); err == nil || err.Error() != "profile data status 0x05: no intervals available for the requested time" {
+		t.Errorf("Got error %v", err)
+	}
+	out.Status, out.ProfileIntervalPeriod = 0, 8
+	if _, err := out.Intervals(1, 1000); err == nil {
+		t.Errorf("Period 8 didn't fail")
+	}
+}
+
+func TestEagleTime(t *testing.T) {
+	const in = `<FastPollStatus>
+    <DeviceMacId>0xd8d5b90000002aea</DeviceMacId>
+    <MeterMacId>0x00078100007d67bb</MeterMacId>
+    <Frequency>0x01</Frequency>
+    <EndTime>0x1b8d9cd0</EndTime>
+  </FastPollStatus>`
+	out := FastPollStatusFragment{}
+	if err := xml.Unmarshal([]byte(in), &out); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	expected := time.Date(2014, time.August, 25, 7, 5, 52, 0, time.UTC)
+	if !out.EndTime.Time().Equal(expected) {
+		t.Errorf("Got: %v instead of %v", out.EndTime, expected)
+	}
+	text, _ := out.EndTime.MarshalText()
+	if string(text) != "0x1b8d9cd0" {
+		t.Errorf("Got: %s instead of 0x1b8d9cd0", text)
+	}
+	js, _ := json.Marshal(out.EndTime)
+	if string(js) != `"2014-08-25T07:05:52Z"` {
+		t.Errorf("Got: %s", js)
+	}
+
+	sentinel := EagleTime{}
+	if err := sentinel.UnmarshalText([]byte("0xffffffff")); err != nil || !sentinel.IsSentinel() {
+		t.Errorf("0xffffffff isn't the sentinel: %v (%v)", sentinel, err)
+	}
+	js, _ = json.Marshal(sentinel)
+	if string(js) != "null" {
+		t.Errorf("Got: %s instead of null", js)
+	}
+	back := EagleTime{}
+	json.Unmarshal(js, &back)
+	if !back.IsSentinel() {
+		t.Errorf("Sentinel didn't survive JSON: %v", back)
+	}
+
+	for _, test := range []struct {
+		in       EagleTime
+		expected string
+	}{
+		{EagleTime{}, "0x00000000"},
+		{sentinel, "0xffffffff"},
+		{NewEagleTime(eagleEpoch), "0x00000000"},
+		{NewEagleTime(time.Date(2014, time.August, 25, 7, 5, 52, 0, time.UTC)), "0x1b8d9cd0"},
+	} {
+		if text, err := test.in.MarshalText(); err != nil || string(text) != test.expected {
+			t.Errorf("%v marshalled to %s (%v) instead of %s", test.in, text, err, test.expected)
+		}
+	}
+	if text, err := NewEagleTime(time.Date(1999, time.December, 31, 0, 0, 0, 0, time.UTC)).MarshalText(); err == nil {
+		t.Errorf("Time before the epoch marshalled to %s", text)
+	}
+}
+
+func TestPriceClusterStart(t *testing.T) {
+	p := PriceCluster{}
+	p.PriceCluster.TimeStamp.UnmarshalText([]byte("0x1b8d9cd0"))
+	p.PriceCluster.StartTime.UnmarshalText([]byte("0xffffffff"))
+	if !p.Start().Equal(p.Time()) {
+		t.Errorf("Start %v should be the timestamp %v", p.Start(), p.Time())
+	}
+	p.PriceCluster.StartTime.UnmarshalText([]byte("0x1b8d9c00"))
+	if p.Start().Equal(p.Time()) {
+		t.Errorf("Start should be the StartTime")
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"math"
+	"strconv"
+)
+
+// Precision is the number of decimal places kept when Power and Energy are
+// formatted or encoded as JSON
+var Precision = 3
+
+// Power is a rate of energy use in kilowatts. It is negative when power is
+// being exported, e.g. from solar panels.
+type Power float64
+
+// Energy is an amount of energy in kilowatt-hours
+type Energy float64
+
+func round(v float64) float64 {
+	p := math.Pow10(Precision)
+	return math.Round(v*p) / p
+}
+
+func formatUnit(v float64, unit string) string {
+	return strconv.FormatFloat(v, 'f', Precision, 64) + unit
+}
+
+func (p Power) String() string {
+	return formatUnit(float64(p), "kW")
+}
+
+func (p Power) Watts() float64 {
+	return float64(p) * 1000
+}
+
+func (p Power) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(round(float64(p)), 'f', -1, 64)), nil
+}
+
+func (e Energy) String() string {
+	return formatUnit(float64(e), "kWh")
+}
+
+func (e Energy) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(round(float64(e)), 'f', -1, 64)), nil
+}
+
+// Sign extend a 24-bit two's complement value
+func int24(raw HexInt) HexInt {
+	raw &= 0xffffff
+	if raw&0x800000 != 0 {
+		raw -= 0x1000000
+	}
+	return raw
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDemandPower(t *testing.T) {
+	tests := []struct {
+		demand, mult, div HexInt
+		expected          Power
+	}{
+		{0x001738, 1, 1000, 5.944},
+		{0x001738, 0, 0, 5944},
+		// Exporting 1.5kW
+		{0xfffa24, 1, 1000, -1.5},
+		{0x7fffff, 1, 1, 8388607},
+		{0x800000, 1, 1, -8388608},
+	}
+	for _, test := range tests {
+		d := InstantaneousDemand{}
+		d.InstantaneousDemand.Demand = test.demand
+		d.InstantaneousDemand.Multiplier = test.mult
+		d.InstantaneousDemand.Divisor = test.div
+		if got := d.Power(); got != test.expected {
+			t.Errorf("%#x*%d/%d: got %v instead of %v", test.demand, test.mult, test.div, got, test.expected)
+		}
+	}
+}
+
+func TestUnitPrecision(t *testing.T) {
+	defer func(saved int) { Precision = saved }(Precision)
+	r := Reading{Demand: Power(1.23456), Delivered: Energy(20060.76749)}
+	js, _ := json.Marshal(r)
+	expected := `{"time":"0001-01-01T00:00:00Z","demand":1.235,"price":{"amount":"0","currency":"","per":"kWh"},"delivered":20060.767,"received":0}`
+	if string(js) != expected {
+		t.Errorf("Got %s instead of %s", js, expected)
+	}
+	Precision = 1
+	if s := r.Demand.String(); s != "1.2kW" {
+		t.Errorf("Got %s instead of 1.2kW", s)
+	}
+	if s := r.Delivered.String(); s != "20060.8kWh" {
+		t.Errorf("Got %s instead of 20060.8kWh", s)
+	}
+}
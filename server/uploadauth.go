@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayCredentials are what an EAGLE has to present to upload. Any one of
+// the username and password (HTTP basic auth), the token (a bearer token or
+// token URL parameter) or the account and auth code of its MeterInfo
+// fragments will do. A gateway without any credentials is let in on its MAC
+// address alone.
+type GatewayCredentials struct {
+	Username string
+	Password string
+	Token    string
+	Account  string
+	Auth     string
+}
+
+func (c GatewayCredentials) empty() bool {
+	return c == GatewayCredentials{}
+}
+
+// UploadSessionTTL is how long a MeterInfo fragment with the right account
+// and auth code lets other uploads in from the same gateway and address.
+// The EAGLE only sends those fields in MeterInfo, not with every fragment.
+var UploadSessionTTL = 24 * time.Hour
+
+var (
+	ErrUnknownGateway = errors.New("gateway not allowed")
+	ErrBadCredentials = errors.New("missing or wrong credentials")
+)
+
+// UploadAuth checks uploads against an allow-list of gateways keyed by MAC
+// address. Uploads that fail are refused or, if Quarantine is set, accepted
+// but kept aside in QuarantineDir instead of being recorded.
+type UploadAuth struct {
+	Gateways      map[string]GatewayCredentials
+	Quarantine    bool
+	QuarantineDir string
+
+	mu       sync.Mutex
+	sessions map[string]time.Time // expiry keyed by gateway and remote host
+}
+
+// Uploads checks the uploads to the HTTP handlers. With no gateways
+// configured every upload is allowed.
+var Uploads = &UploadAuth{}
+
+// Compare secrets in constant time. Hashing them first means the time taken
+// doesn't even give away the length.
+func secureCompare(given, expected string) bool {
+	a, b := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Check whether an upload is allowed. msg is the parsed upload and body the
+// whole of it.
+func (u *UploadAuth) Check(req *http.Request, msg Request, body []byte) error {
+	if len(u.Gateways) == 0 {
+		return nil
+	}
+	gateway := msg.MacId.String()
+	creds, ok := u.Gateways[gateway]
+	if !ok {
+		return ErrUnknownGateway
+	}
+	if creds.empty() {
+		return nil
+	}
+	if username, password, ok := req.BasicAuth(); ok && creds.Username != "" {
+		if secureCompare(username, creds.Username) && secureCompare(password, creds.Password) {
+			return nil
+		}
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != "" && creds.Token != "" && secureCompare(token, creds.Token) {
+		return nil
+	}
+	session := gateway + " " + remoteHost(req)
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if msg.Fragment.XMLName.Local == "MeterInfo" && creds.Account != "" {
+		info := MeterInfo{}
+		if err := xml.Unmarshal(body, &info); err != nil {
+			return err
+		}
+		m := info.MeterInfo
+		if secureCompare(m.Account, creds.Account) && secureCompare(m.Auth, creds.Auth) {
+			if u.sessions == nil {
+				u.sessions = make(map[string]time.Time)
+			}
+			u.sessions[session] = now.Add(UploadSessionTTL)
+			return nil
+		}
+		delete(u.sessions, session)
+	}
+	if expiry, ok := u.sessions[session]; ok {
+		if now.Before(expiry) {
+			return nil
+		}
+		delete(u.sessions, session)
+	}
+	return ErrBadCredentials
+}
+
+// Keep a refused upload for inspection
+func (u *UploadAuth) quarantine(msg Request, body []byte) error {
+	if u.QuarantineDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(u.QuarantineDir, 0755); err != nil {
+		return err
+	}
+	mac := strings.Replace(msg.MacId.String(), ":", "", -1)
+	name := fmt.Sprintf("%020d-%s.xml", time.Now().UnixNano(), mac)
+	path := filepath.Join(u.QuarantineDir, name)
+	if err := writeFileSync(path+tmpExt, body); err != nil {
+		return err
+	}
+	return os.Rename(path+tmpExt, path)
+}
+
+// Refuse an upload that failed Check, either with a 401 or by quarantining it
+func (u *UploadAuth) Refuse(w http.ResponseWriter, req *http.Request, msg Request, body []byte, reason error) {
+	action := "rejected"
+	if u.Quarantine {
+		action = "quarantined"
+	}
+	log.Printf("Upload from %s (%s) %s: %v", msg.MacId, req.RemoteAddr, action, reason)
+	Prometheus.Inc("eagle_uploads_refused_total", "gateway", msg.MacId.String(), "action", action)
+	if !u.Quarantine {
+		w.Header().Set("WWW-Authenticate", `Basic realm="eagle"`)
+		w.WriteHeader(401)
+		return
+	}
+	if err := u.quarantine(msg, body); err != nil {
+		log.Printf("Quarantining upload from %s: %v", msg.MacId, err)
+	}
+	w.WriteHeader(202)
+}
+
+// ConfigureUploads reads the allow-list from environment variables, given in
+// the form returned by os.Environ.
+//
+// UPLOAD_GATEWAYS is a comma separated list of gateway MAC addresses. The
+// credentials for each are read from GATEWAY_<MAC>_<SETTING> variables, where
+// MAC is the address in hex without the 0x and SETTING is USERNAME, PASSWORD,
+// TOKEN, ACCOUNT or AUTH. UPLOAD_USERNAME, UPLOAD_PASSWORD and UPLOAD_TOKEN
+// are shared by every gateway that doesn't have its own.
+//
+// UPLOAD_AUTH_FAILURE is either reject (the default) or quarantine. Refused
+// uploads are quarantined in DATA_DIR/quarantine.
+func (u *UploadAuth) ConfigureUploads(environ []string) error {
+	env := EnvironMap(environ)
+	shared := GatewayCredentials{
+		Username: env["UPLOAD_USERNAME"],
+		Password: env["UPLOAD_PASSWORD"],
+		Token:    env["UPLOAD_TOKEN"],
+	}
+	gateways := make(map[string]GatewayCredentials)
+	for _, entry := range strings.Split(env["UPLOAD_GATEWAYS"], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		mac, err := ParseMacAddr(entry)
+		if err != nil {
+			return fmt.Errorf("UPLOAD_GATEWAYS: %v", err)
+		}
+		prefix := "GATEWAY_" + strings.ToUpper(strings.Replace(mac, ":", "", -1)) + "_"
+		creds := GatewayCredentials{
+			Username: env[prefix+"USERNAME"],
+			Password: env[prefix+"PASSWORD"],
+			Token:    env[prefix+"TOKEN"],
+			Account:  env[prefix+"ACCOUNT"],
+			Auth:     env[prefix+"AUTH"],
+		}
+		if creds.Username == "" && creds.Token == "" {
+			creds.Username, creds.Password, creds.Token = shared.Username, shared.Password, shared.Token
+		}
+		gateways[mac] = creds
+	}
+	if len(gateways) == 0 && !shared.empty() {
+		return errors.New("UPLOAD_GATEWAYS must list the gateways allowed to use the shared credentials")
+	}
+	switch env["UPLOAD_AUTH_FAILURE"] {
+	case "", "reject":
+	case "quarantine":
+		u.Quarantine = true
+	default:
+		return fmt.Errorf("UPLOAD_AUTH_FAILURE: unknown action %q", env["UPLOAD_AUTH_FAILURE"])
+	}
+	if dir := env["DATA_DIR"]; dir != "" {
+		u.QuarantineDir = filepath.Join(dir, "quarantine")
+	}
+	u.Gateways = gateways
+	return nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const meterInfo = `<rainforest macId="0xf0ad4e00ce69">
+  <MeterInfo>
+    <DeviceMacId>0x00158d0000000004</DeviceMacId>
+    <MeterMacId>0x00178d0000000004</MeterMacId>
+    <Type>electric</Type>
+    <Account>12345</Account>
+    <Auth>s3cret</Auth>
+  </MeterInfo>
+</rainforest>`
+
+func upload(body string, auth func(req *http.Request)) *httptest.ResponseRecorder {
+	record := httptest.NewRecorder()
+	req := &http.Request{
+		Method:     "POST",
+		URL:        &url.URL{Path: "/metrics"},
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		RemoteAddr: "192.0.2.1:1234",
+	}
+	if auth != nil {
+		auth(req)
+	}
+	MetricsHandler(record, req)
+	return record
+}
+
+func TestUploadAuth(t *testing.T) {
+	savedUploads, savedReadings := Uploads, Readings
+	defer func() { Uploads, Readings = savedUploads, savedReadings }()
+	Uploads, Readings = &UploadAuth{}, NewMemoryStore(10)
+	err := Uploads.ConfigureUploads([]string{
+		"UPLOAD_GATEWAYS=0xf0ad4e00ce69,f0:ad:4e:00:ce:70",
+		"UPLOAD_TOKEN=shared",
+		"GATEWAY_F0AD4E00CE69_USERNAME=eagle",
+		"GATEWAY_F0AD4E00CE69_PASSWORD=pass",
+		"GATEWAY_F0AD4E00CE69_ACCOUNT=12345",
+		"GATEWAY_F0AD4E00CE69_AUTH=s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	demand := gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "InstantaneousDemand")
+	other := gatewayFragment("0xf0ad4e00ce70", "0x00178d0000000005", "InstantaneousDemand")
+	stranger := gatewayFragment("0xf0ad4e00ce71", "0x00178d0000000006", "InstantaneousDemand")
+	tests := []struct {
+		name     string
+		body     string
+		auth     func(req *http.Request)
+		expected int
+	}{
+		{"no credentials", demand, nil, 401},
+		{"wrong password", demand, func(req *http.Request) { req.SetBasicAuth("eagle", "wrong") }, 401},
+		{"basic auth", demand, func(req *http.Request) { req.SetBasicAuth("eagle", "pass") }, 200},
+		{"shared token for a gateway with its own credentials", demand, func(req *http.Request) { req.Header.Set("Authorization", "Bearer shared") }, 401},
+		{"shared token", other, func(req *http.Request) { req.Header.Set("Authorization", "Bearer shared") }, 200},
+		{"token parameter", other, func(req *http.Request) { req.URL.RawQuery = "token=shared" }, 200},
+		{"unknown gateway", stranger, func(req *http.Request) { req.Header.Set("Authorization", "Bearer shared") }, 401},
+		{"meter info", meterInfo, nil, 200},
+		{"after meter info", demand, nil, 200},
+		{"after meter info from elsewhere", demand, func(req *http.Request) { req.RemoteAddr = "192.0.2.2:1234" }, 401},
+	}
+	for _, test := range tests {
+		if record := upload(test.body, test.auth); record.Code != test.expected {
+			t.Errorf("%s: got %d instead of %d", test.name, record.Code, test.expected)
+		}
+	}
+	if len(Readings.Range(time.Time{}, time.Time{})) != 4 {
+		t.Errorf("Expected 4 readings, got %+v", Readings.Range(time.Time{}, time.Time{}))
+	}
+}
+
+func TestUploadQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	savedUploads, savedReadings := Uploads, Readings
+	defer func() { Uploads, Readings = savedUploads, savedReadings }()
+	Uploads, Readings = &UploadAuth{}, NewMemoryStore(10)
+	err := Uploads.ConfigureUploads([]string{
+		"UPLOAD_GATEWAYS=f0ad4e00ce69",
+		"UPLOAD_TOKEN=shared",
+		"UPLOAD_AUTH_FAILURE=quarantine",
+		"DATA_DIR=" + dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := upload(gatewayFragment("0xf0ad4e00ce69", "0x00178d0000000004", "InstantaneousDemand"), nil); record.Code != 202 {
+		t.Errorf("Got %d instead of 202", record.Code)
+	}
+	if n := len(Readings.Range(time.Time{}, time.Time{})); n != 0 {
+		t.Errorf("Quarantined upload made %d readings", n)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "quarantine", "*-f0ad4e00ce69.xml"))
+	if len(files) != 1 {
+		t.Errorf("Got quarantined files %v", files)
+	}
+}
+
+func TestConfigureUploadsErrors(t *testing.T) {
+	for _, environ := range [][]string{
+		{"UPLOAD_TOKEN=shared"},
+		{"UPLOAD_GATEWAYS=nonsense"},
+		{"UPLOAD_GATEWAYS=f0ad4e00ce69", "UPLOAD_AUTH_FAILURE=ignore"},
+	} {
+		if err := (&UploadAuth{}).ConfigureUploads(environ); err == nil {
+			t.Errorf("Expected an error from %v", environ)
+		}
+	}
+}